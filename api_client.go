@@ -2,13 +2,13 @@ package gopify
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -19,7 +19,8 @@ const (
 )
 
 var (
-	ErrRateLimit = errors.New("API rate limit exeeded")
+	ErrRateLimit     = errors.New("API rate limit exeeded")
+	ErrNoGraphqlData = errors.New("graphql response has no data")
 )
 
 // ResponseError represnts any Shopify REST API response error
@@ -31,15 +32,6 @@ func (err ResponseError) Error() string {
 	return fmt.Sprintf("%v", err.Errors)
 }
 
-// GraphqlErr is a general graphql error
-type GraphqlError struct {
-	msg string
-}
-
-func (err GraphqlError) Error() string {
-	return err.msg
-}
-
 type RestResponse struct {
 	Headers    http.Header
 	Pagination *Pagination
@@ -62,13 +54,30 @@ func WithTimeout(seconds int) Option {
 	}
 }
 
-// WithRetries tells the Api client how many retries to perform when hit a rate limit
+// WithRetries tells the Api client how many tries to perform when hit a rate limit,
+// at least one try is always made
 func WithRetry(tries int) Option {
 	return func(c *Client) {
 		c.tries = tries
 	}
 }
 
+// WithLimiterRegistry sets the registry the client takes its per shop rate limiters from,
+// by default DefaultLimiterRegistry is used
+func WithLimiterRegistry(r *LimiterRegistry) Option {
+	return func(c *Client) {
+		c.limiters = r
+	}
+}
+
+// WithTokenSource makes the client take its access token from ts instead of the static access token,
+// a request rejected with 401 is retried once with a fresh token
+func WithTokenSource(ts TokenSource) Option {
+	return func(c *Client) {
+		c.tokenSource = ts
+	}
+}
+
 // Body is an API request/response body
 type Body map[string]any
 
@@ -80,7 +89,10 @@ type Client struct {
 	accessToken    string
 	version        string
 	tries          int
-	availableLimit int // used for handling rate limits
+	limiters       *LimiterRegistry
+	restLimiter    *RestLimiter
+	graphqlLimiter *GraphqlLimiter
+	tokenSource    TokenSource
 }
 
 // Create a new shopify Api client
@@ -90,24 +102,29 @@ func NewClient(domain, accessToken string, opts ...Option) *Client {
 		Timeout: defaultTimeout,
 	}
 	c := &Client{
-		client:         &client,
-		domain:         domain,
-		accessToken:    accessToken,
-		version:        defaultApiVersion,
-		tries:          defaultRetries,
-		availableLimit: 0,
+		client:      &client,
+		domain:      domain,
+		accessToken: accessToken,
+		version:     defaultApiVersion,
+		tries:       defaultRetries,
+		limiters:    DefaultLimiterRegistry,
 	}
 
 	for _, opt := range opts {
 		opt(c)
 	}
+	if c.tries < 1 {
+		c.tries = 1
+	}
+	c.restLimiter = c.limiters.Rest(domain)
+	c.graphqlLimiter = c.limiters.Graphql(domain)
 	baseUrl := fmt.Sprintf("https://%s/admin/api/%s", domain, c.version)
 	c.baseUrl = baseUrl
 
 	return c
 }
 
-func (c *Client) newRequest(method string, path string, queryParams url.Values, requestBody any) (*http.Request, error) {
+func (c *Client) newRequest(ctx context.Context, method string, path string, queryParams url.Values, requestBody any) (*http.Request, error) {
 	u, err := url.Parse(fmt.Sprintf("%s/%s", c.baseUrl, path))
 	if err != nil {
 		return nil, err
@@ -122,56 +139,79 @@ func (c *Client) newRequest(method string, path string, queryParams url.Values,
 			return nil, err
 		}
 	}
-	req, err := http.NewRequest(method, u.String(), bytes.NewBuffer(b))
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewBuffer(b))
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("X-Shopify-Access-Token", c.accessToken)
+	accessToken := c.accessToken
+	if c.tokenSource != nil {
+		token, err := c.tokenSource.Token(ctx)
+		if err != nil {
+			return nil, err
+		}
+		accessToken = token.AccessToken
+	}
+	req.Header.Add("X-Shopify-Access-Token", accessToken)
 	req.Header.Add("Content-Type", "application/json")
 
 	return req, nil
 }
 
-func (c *Client) rest(method string, path string, queryParams url.Values, requestBody any, responseBody any) (*RestResponse, error) {
-	threshold := 2 // rate limit threshold
-	req, err := c.newRequest(method, path, queryParams, requestBody)
+// send builds and sends a request, when the token from the token source is rejected
+// the token is invalidated and the request is sent once more
+func (c *Client) send(ctx context.Context, method string, path string, queryParams url.Values, requestBody any) (*http.Response, error) {
+	req, err := c.newRequest(ctx, method, path, queryParams, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.client.Do(req)
+	if err != nil || res.StatusCode != http.StatusUnauthorized || c.tokenSource == nil {
+		return res, err
+	}
+	res.Body.Close()
+
+	if invalidator, ok := c.tokenSource.(interface{ Invalidate() }); ok {
+		invalidator.Invalidate()
+	}
+	req, err = c.newRequest(ctx, method, path, queryParams, requestBody)
 	if err != nil {
 		return nil, err
 	}
+	return c.client.Do(req)
+}
+
+func (c *Client) rest(ctx context.Context, method string, path string, queryParams url.Values, requestBody any, responseBody any) (*RestResponse, error) {
 	var res *http.Response
 
 	for t := 1; t <= c.tries; t++ {
-		res, err = c.client.Do(req)
+		if err := c.restLimiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+		// the request is rebuilt on every try because its body is consumed by the previous one
+		var err error
+		res, err = c.send(ctx, method, path, queryParams, requestBody)
 		if err != nil {
 			return nil, err
 		}
 		defer res.Body.Close()
+		c.restLimiter.update(res.Header.Get("X-Shopify-Shop-Api-Call-Limit"))
 
 		if res.StatusCode == http.StatusTooManyRequests {
-			retryAfter := res.Header.Get("Retry-After")
+			retryAfter, _ := strconv.ParseFloat(res.Header.Get("Retry-After"), 64)
+			c.restLimiter.block(time.Duration(retryAfter * float64(time.Second)))
 			if t == c.tries {
 				return nil, ErrRateLimit
 			}
-			r, _ := strconv.Atoi(retryAfter)
-			time.Sleep(time.Second * time.Duration(r))
 			continue
 		}
 
 		if res.StatusCode >= http.StatusMultipleChoices {
 			return nil, parseResponseError(res)
 		}
-
-		limit := res.Header.Get("X-Shopify-Shop-Api-Call-Limit")
-		if s := strings.Split(limit, "/"); len(s) == 2 {
-			bucketSize, _ := strconv.Atoi(s[1])
-			requestCount, _ := strconv.Atoi(s[0])
-			c.availableLimit = bucketSize - requestCount
-		}
-
-		if c.availableLimit < threshold {
-			time.Sleep(time.Second * 2)
-			continue
-		}
+		break
+	}
+	if res == nil {
+		return nil, ErrRateLimit
 	}
 	if err := json.NewDecoder(res.Body).Decode(&responseBody); err != nil {
 		return nil, err
@@ -195,92 +235,108 @@ func parseResponseError(res *http.Response) error {
 	return responseError
 }
 
-// checks if a graphql response has a rate limit error and return it if exists
-func (c *Client) rateLimitError(errors []any) bool {
+// graphqlCost is the query cost information returned in the graphql response extensions
+type graphqlCost struct {
+	RequestedQueryCost float64         `json:"requestedQueryCost"`
+	ThrottleStatus     *throttleStatus `json:"throttleStatus"`
+}
+
+type graphqlResponse struct {
+	Data       json.RawMessage `json:"data"`
+	Errors     []GraphqlError  `json:"errors"`
+	Extensions struct {
+		Cost *graphqlCost `json:"cost"`
+	} `json:"extensions"`
+}
+
+// checks if a graphql response has a throttling error that is worth retrying
+func throttled(errors []GraphqlError) bool {
 	for _, err := range errors {
-		if ext, ok := err.(map[string]any); ok {
-			if e, ok := ext["extensions"].(map[string]any); ok {
-				code, ok := e["code"].(string)
-				if ok && (code == "MAX_COST_EXCEEDED" || code == "THROTTLED") {
-					return true
-				}
-			}
+		if err.Code() == GraphqlThrottled {
+			return true
 		}
 	}
 	return false
 }
 
-// get the current available rate limit from the graphql response
-func (c *Client) graphqlAvailableLimit(extentions map[string]any) int {
-	if cost, ok := extentions["cost"].(map[string]any); ok {
-		if throttleStatus, ok := cost["throttleStatus"].(map[string]any); ok {
-			if currentlyAvailable, ok := throttleStatus["currentlyAvailable"].(float64); ok {
-				return int(currentlyAvailable)
-			}
-		}
+// doGraphql sends a single graphql request once the shop can afford its cost
+func (c *Client) doGraphql(ctx context.Context, body Body, cost int) (*graphqlResponse, error) {
+	reserved, err := c.graphqlLimiter.wait(ctx, cost)
+	if err != nil {
+		return nil, err
 	}
-	return -1
-}
+	var status *throttleStatus
+	defer func() {
+		c.graphqlLimiter.done(reserved, status)
+	}()
 
-func (c *Client) graphql(body Body) (Body, error) {
-	threshold := 50
-	req, err := c.newRequest(http.MethodPost, "graphql.json", nil, body)
+	res, err := c.send(ctx, http.MethodPost, "graphql.json", nil, body)
 	if err != nil {
 		return nil, err
 	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected server response: %s", res.Status)
+	}
+	result := &graphqlResponse{}
+	if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	if result.Extensions.Cost != nil {
+		status = result.Extensions.Cost.ThrottleStatus
+	}
+	return result, nil
+}
+
+// hasData reports whether the response carries a non null data field
+func (r *graphqlResponse) hasData() bool {
+	return len(r.Data) > 0 && string(r.Data) != "null"
+}
+
+// graphql sends the query, retrying when throttled. The response is returned even when it has errors
+// so callers can use the partial data.
+func (c *Client) graphql(ctx context.Context, body Body) (*graphqlResponse, error) {
+	cost := queryCostFromContext(ctx)
 
 	for t := 1; t <= c.tries; t++ {
-		res, err := c.client.Do(req)
+		result, err := c.doGraphql(ctx, body, cost)
 		if err != nil {
 			return nil, err
 		}
-		defer res.Body.Close()
-
-		if res.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("unexpected server response: %s", res.Status)
-		}
-		result := make(map[string]any)
-		dec := json.NewDecoder(res.Body)
-		if err := dec.Decode(&result); err != nil {
-			return nil, err
-		}
 
 		// handle errors
-		if e, ok := result["errors"]; ok {
-			errs := e.([]any)
-			// rate limit error
-			if c.rateLimitError(errs) {
-				if t == c.tries {
-					return nil, ErrRateLimit
-				}
-				time.Sleep(2 * time.Second)
-				continue
-			} else {
-				if errMessage, ok := errs[0].(map[string]any)["message"].(string); ok {
-					return nil, GraphqlError{msg: errMessage}
-				}
+		if throttled(result.Errors) {
+			if t == c.tries {
+				return nil, ErrRateLimit
 			}
-		}
-
-		// check available rate limit
-		if e, ok := result["extensions"]; ok {
-			l := c.graphqlAvailableLimit(e.(map[string]any))
-			if l != -1 {
-				c.availableLimit = l
+			// wait for exactly what the query needs on the next try
+			if result.Extensions.Cost != nil && result.Extensions.Cost.RequestedQueryCost > 0 {
+				cost = int(result.Extensions.Cost.RequestedQueryCost)
 			}
-		}
-		if c.availableLimit < threshold {
-			time.Sleep(2 * time.Second)
 			continue
 		}
-		return result["data"].(map[string]any), nil
+		errs := GraphqlErrors{
+			Errors:     result.Errors,
+			UserErrors: collectUserErrors(result.Data),
+		}
+		if len(errs.Errors) > 0 || len(errs.UserErrors) > 0 {
+			// shopify may send partial data along with the errors
+			return result, errs
+		}
+		return result, nil
 	}
-	return nil, nil
+	return nil, ErrRateLimit
 }
 
 // Get performs a get request and returns the result
 func (c *Client) Get(path string, queryParams url.Values, responseBody any) (*RestResponse, error) {
-	r, err := c.rest(http.MethodGet, path, queryParams, nil, responseBody)
+	return c.GetCtx(context.Background(), path, queryParams, responseBody)
+}
+
+// GetCtx is like Get but uses ctx for the request and any retry waits
+func (c *Client) GetCtx(ctx context.Context, path string, queryParams url.Values, responseBody any) (*RestResponse, error) {
+	r, err := c.rest(ctx, http.MethodGet, path, queryParams, nil, responseBody)
 	if err != nil {
 		return nil, err
 	}
@@ -294,26 +350,83 @@ func (c *Client) Get(path string, queryParams url.Values, responseBody any) (*Re
 
 // post performs a post request and returns the result
 func (c *Client) Post(path string, requestBody any, responseBody any) (*RestResponse, error) {
-	return c.rest(http.MethodPost, path, nil, requestBody, requestBody)
+	return c.PostCtx(context.Background(), path, requestBody, responseBody)
+}
+
+// PostCtx is like Post but uses ctx for the request and any retry waits
+func (c *Client) PostCtx(ctx context.Context, path string, requestBody any, responseBody any) (*RestResponse, error) {
+	return c.rest(ctx, http.MethodPost, path, nil, requestBody, responseBody)
 }
 
 // Put performs a put request and returns the result
 func (c *Client) Put(path string, requestBody any, responseBody any) (*RestResponse, error) {
-	return c.rest(http.MethodPut, path, nil, requestBody, responseBody)
+	return c.PutCtx(context.Background(), path, requestBody, responseBody)
+}
+
+// PutCtx is like Put but uses ctx for the request and any retry waits
+func (c *Client) PutCtx(ctx context.Context, path string, requestBody any, responseBody any) (*RestResponse, error) {
+	return c.rest(ctx, http.MethodPut, path, nil, requestBody, responseBody)
 }
 
 // Delete performs a delete request
 func (c *Client) Delete(path string) (*RestResponse, error) {
-	return c.rest(http.MethodDelete, path, nil, nil, nil)
+	return c.DeleteCtx(context.Background(), path)
+}
+
+// DeleteCtx is like Delete but uses ctx for the request and any retry waits
+func (c *Client) DeleteCtx(ctx context.Context, path string) (*RestResponse, error) {
+	return c.rest(ctx, http.MethodDelete, path, nil, nil, nil)
 }
 
 // Graphql sends a graphql query to shopify admin api.
+//
+// When the response has errors or its mutations return userErrors, they are all returned in a GraphqlErrors
+// along with any partial data shopify sent.
 func (c *Client) Graphql(query string, variables map[string]any) (Body, error) {
+	return c.GraphqlCtx(context.Background(), query, variables)
+}
+
+// GraphqlCtx is like Graphql but uses ctx for the request and the throttling waits
+func (c *Client) GraphqlCtx(ctx context.Context, query string, variables map[string]any) (Body, error) {
+	result, err := c.graphql(ctx, graphqlBody(query, variables))
+	if result == nil || !result.hasData() {
+		return nil, err
+	}
+	data := Body{}
+	if err := json.Unmarshal(result.Data, &data); err != nil {
+		return nil, err
+	}
+	return data, err
+}
+
+// GraphqlInto sends a graphql query and decodes the response data into out,
+// which is usually a pointer to a struct with json tags matching the query.
+//
+// ErrNoGraphqlData is returned when the response has neither data nor errors.
+// Like Graphql, partial data is decoded into out when a GraphqlErrors is returned.
+func (c *Client) GraphqlInto(ctx context.Context, query string, variables map[string]any, out any) error {
+	result, err := c.graphql(ctx, graphqlBody(query, variables))
+	if result == nil {
+		return err
+	}
+	if !result.hasData() {
+		if err != nil {
+			return err
+		}
+		return ErrNoGraphqlData
+	}
+	if err := json.Unmarshal(result.Data, out); err != nil {
+		return err
+	}
+	return err
+}
+
+func graphqlBody(query string, variables map[string]any) Body {
 	body := map[string]any{
 		"query": query,
 	}
 	if variables != nil {
 		body["variables"] = variables
 	}
-	return c.graphql(body)
+	return body
 }
@@ -1,11 +1,14 @@
 package gopify
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestGet(t *testing.T) {
@@ -60,3 +63,100 @@ func TestGet(t *testing.T) {
 		}
 	}
 }
+
+func TestGetCtxCancelled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "10")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	apiClient := NewClient(ts.URL[7:], "access token")
+	apiClient.baseUrl = fmt.Sprintf("%s/admin/api/%s", ts.URL, apiClient.version)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := apiClient.GetCtx(ctx, "products.json", nil, &map[string]any{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected error %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("GetCtx returned after %v, expected it to stop when the context expired", elapsed)
+	}
+}
+
+func TestGraphqlInto(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]any{}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch body["query"] {
+		case "{ shop { name } }":
+			fmt.Fprint(w, `{"data": {"shop": {"name": "test", "id": "gid://shopify/Shop/1"}}}`)
+		case "{ shop { id } }":
+			fmt.Fprint(w, `{"data": {"shop": {"name": ["unexpected"]}}}`)
+		default:
+			fmt.Fprint(w, `{"data": null}`)
+		}
+	}))
+	defer ts.Close()
+
+	apiClient := NewClient(ts.URL[7:], "access token")
+	apiClient.baseUrl = fmt.Sprintf("%s/admin/api/%s", ts.URL, apiClient.version)
+
+	var result struct {
+		Shop struct {
+			Name string `json:"name"`
+		} `json:"shop"`
+	}
+	if err := apiClient.GraphqlInto(context.Background(), "{ shop { name } }", nil, &result); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if result.Shop.Name != "test" {
+		t.Errorf("expected shop name %q got %q", "test", result.Shop.Name)
+	}
+
+	if err := apiClient.GraphqlInto(context.Background(), "{ shop { id } }", nil, &result); err == nil {
+		t.Errorf("expected an error when data doesn't match the result type")
+	}
+
+	if err := apiClient.GraphqlInto(context.Background(), "{ nothing }", nil, &result); err != ErrNoGraphqlData {
+		t.Errorf("expected error %v got %v", ErrNoGraphqlData, err)
+	}
+	if data, err := apiClient.Graphql("{ nothing }", nil); data != nil || err != nil {
+		t.Errorf("expected no data and no error got %v, %v", data, err)
+	}
+}
+
+func TestWithoutRetries(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path == "/admin/api/"+defaultApiVersion+"/graphql.json" {
+			fmt.Fprint(w, `{"data":{"shop":{"name":"test"}}}`)
+			return
+		}
+		fmt.Fprint(w, `{"shop":{"name":"test"}}`)
+	}))
+	defer ts.Close()
+
+	// a client is always allowed one try
+	apiClient := NewClient(ts.URL[7:], "access token", WithRetry(0), WithLimiterRegistry(NewLimiterRegistry()))
+	apiClient.baseUrl = fmt.Sprintf("%s/admin/api/%s", ts.URL, apiClient.version)
+
+	res := map[string]any{}
+	if _, err := apiClient.GetCtx(context.Background(), "shop.json", nil, &res); err != nil || fmt.Sprint(res) != "map[shop:map[name:test]]" {
+		t.Errorf("unexpected response %v, %v", res, err)
+	}
+	out := struct {
+		Shop struct {
+			Name string `json:"name"`
+		} `json:"shop"`
+	}{}
+	if err := apiClient.GraphqlInto(context.Background(), "{ shop { name } }", nil, &out); err != nil || out.Shop.Name != "test" {
+		t.Errorf("unexpected response %+v, %v", out, err)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 requests got %d", calls)
+	}
+}
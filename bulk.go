@@ -0,0 +1,482 @@
+package gopify
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"time"
+)
+
+// bulk operation types
+const (
+	BulkQuery    = "QUERY"
+	BulkMutation = "MUTATION"
+)
+
+// bulk operation statuses
+const (
+	BulkOperationCreated   = "CREATED"
+	BulkOperationRunning   = "RUNNING"
+	BulkOperationCompleted = "COMPLETED"
+	BulkOperationCanceling = "CANCELING"
+	BulkOperationCanceled  = "CANCELED"
+	BulkOperationFailed    = "FAILED"
+	BulkOperationExpired   = "EXPIRED"
+)
+
+const (
+	defaultBulkPollInterval = 5 * time.Second
+	// bulkCancelTimeout bounds the request canceling an operation after the caller's context ended
+	bulkCancelTimeout = 10 * time.Second
+)
+
+var (
+	ErrBulkOperationFailed   = errors.New("bulk operation did not complete")
+	ErrBulkVariablesTooLarge = errors.New("bulk mutation variables exceed the staged upload limit")
+)
+
+// maxBulkVariablesSize is the largest JSONL variables file shopify accepts for a bulk mutation
+var maxBulkVariablesSize = 100 << 20
+
+const bulkOperationFields = `id status errorCode type objectCount fileSize url partialDataUrl createdAt completedAt`
+
+// BulkOperation is an asynchronous bulk query or mutation running on shopify
+type BulkOperation struct {
+	ID             string `json:"id"`
+	Status         string `json:"status"`
+	ErrorCode      string `json:"errorCode"`
+	Type           string `json:"type"`
+	ObjectCount    string `json:"objectCount"`
+	FileSize       string `json:"fileSize"`
+	URL            string `json:"url"`
+	PartialDataURL string `json:"partialDataUrl"`
+	CreatedAt      string `json:"createdAt"`
+	CompletedAt    string `json:"completedAt"`
+}
+
+// Done reports whether the operation stopped running
+func (op *BulkOperation) Done() bool {
+	switch op.Status {
+	case BulkOperationCompleted, BulkOperationCanceled, BulkOperationFailed, BulkOperationExpired:
+		return true
+	}
+	return false
+}
+
+// BulkWaitOptions configures how WaitBulkOperation watches an operation
+type BulkWaitOptions struct {
+	// PollInterval is the time between two status checks, 5 seconds when 0
+	PollInterval time.Duration
+	// Notify triggers a status check right away, send on it when the bulk_operations/finish webhook is received
+	Notify <-chan struct{}
+}
+
+// RunBulkQuery submits query as a bulk operation, the query must not declare any variable
+func (c *Client) RunBulkQuery(ctx context.Context, query string) (*BulkOperation, error) {
+	mutation := `mutation ($query: String!) {
+		bulkOperationRunQuery(query: $query) {
+			bulkOperation { ` + bulkOperationFields + ` }
+			userErrors { field message code }
+		}
+	}`
+	result := struct {
+		BulkOperationRunQuery struct {
+			BulkOperation *BulkOperation `json:"bulkOperation"`
+		} `json:"bulkOperationRunQuery"`
+	}{}
+	if err := c.GraphqlInto(ctx, mutation, map[string]any{"query": query}, &result); err != nil {
+		return nil, err
+	}
+	if result.BulkOperationRunQuery.BulkOperation == nil {
+		return nil, ErrNoGraphqlData
+	}
+	return result.BulkOperationRunQuery.BulkOperation, nil
+}
+
+// CurrentBulkOperation returns the last bulk operation of the given type (BulkQuery or BulkMutation) started by the app,
+// or nil if there is none
+func (c *Client) CurrentBulkOperation(ctx context.Context, operationType string) (*BulkOperation, error) {
+	query := `query ($type: BulkOperationType!) {
+		currentBulkOperation(type: $type) { ` + bulkOperationFields + ` }
+	}`
+	result := struct {
+		CurrentBulkOperation *BulkOperation `json:"currentBulkOperation"`
+	}{}
+	if err := c.GraphqlInto(ctx, query, map[string]any{"type": operationType}, &result); err != nil {
+		return nil, err
+	}
+	return result.CurrentBulkOperation, nil
+}
+
+// bulkOperation returns the bulk operation with the given id
+func (c *Client) bulkOperation(ctx context.Context, id string) (*BulkOperation, error) {
+	query := `query ($id: ID!) {
+		node(id: $id) { ... on BulkOperation { ` + bulkOperationFields + ` } }
+	}`
+	result := struct {
+		Node *BulkOperation `json:"node"`
+	}{}
+	if err := c.GraphqlInto(ctx, query, map[string]any{"id": id}, &result); err != nil {
+		return nil, err
+	}
+	if result.Node == nil {
+		return nil, fmt.Errorf("bulk operation %s not found", id)
+	}
+	return result.Node, nil
+}
+
+// WaitBulkOperation polls the status of op until it is done and returns its final state.
+//
+// An error wrapping ErrBulkOperationFailed is returned along with the operation when it doesn't complete,
+// its PartialDataURL may still hold some results.
+func (c *Client) WaitBulkOperation(ctx context.Context, op *BulkOperation, opts BulkWaitOptions) (*BulkOperation, error) {
+	interval := opts.PollInterval
+	if interval <= 0 {
+		interval = defaultBulkPollInterval
+	}
+	operationType := op.Type
+	if operationType == "" {
+		operationType = BulkQuery
+	}
+
+	for {
+		current, err := c.CurrentBulkOperation(ctx, operationType)
+		if err != nil {
+			return nil, err
+		}
+		// another operation was started since, look ours up directly
+		if current == nil || current.ID != op.ID {
+			current, err = c.bulkOperation(ctx, op.ID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if current.Done() {
+			if current.Status != BulkOperationCompleted {
+				return current, fmt.Errorf("%w: %s %s %s", ErrBulkOperationFailed, current.ID, current.Status, current.ErrorCode)
+			}
+			return current, nil
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-opts.Notify:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// BulkObject is an object of a bulk operation result along with the objects nested under it
+type BulkObject struct {
+	ID       string
+	ParentID string
+	Data     json.RawMessage // the raw JSONL line
+	Children []*BulkObject
+}
+
+// Decode unmarshals the object data into v
+func (o *BulkObject) Decode(v any) error {
+	return json.Unmarshal(o.Data, v)
+}
+
+// StreamBulkResults downloads the JSONL file of a bulk operation and calls fn with every top level object,
+// once all of its nested objects, linked by their __parentId, have been attached to it.
+func (c *Client) StreamBulkResults(ctx context.Context, url string, fn func(obj *BulkObject) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	// the download can take longer than the API timeout
+	res, err := (&http.Client{Transport: c.client.Transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected server response: %s", res.Status)
+	}
+
+	var root *BulkObject
+	index := map[string]*BulkObject{}
+	reader := bufio.NewReader(res.Body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && string(line) != "\n" {
+			ids := struct {
+				ID       string `json:"id"`
+				ParentID string `json:"__parentId"`
+			}{}
+			if err := json.Unmarshal(line, &ids); err != nil {
+				return err
+			}
+			obj := &BulkObject{ID: ids.ID, ParentID: ids.ParentID, Data: json.RawMessage(line)}
+
+			if obj.ParentID == "" {
+				if root != nil {
+					if err := fn(root); err != nil {
+						return err
+					}
+				}
+				root = obj
+				index = map[string]*BulkObject{}
+			} else {
+				parent, ok := index[obj.ParentID]
+				if !ok {
+					return fmt.Errorf("bulk object %s has an unknown parent %s", obj.ID, obj.ParentID)
+				}
+				parent.Children = append(parent.Children, obj)
+			}
+			if obj.ID != "" {
+				index[obj.ID] = obj
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if root != nil {
+		return fn(root)
+	}
+	return nil
+}
+
+// BulkQuery runs query as a bulk operation, waits for it to complete and streams its results to fn.
+// The operation is canceled on shopify when ctx ends before it completes.
+func (c *Client) BulkQuery(ctx context.Context, query string, opts BulkWaitOptions, fn func(obj *BulkObject) error) error {
+	op, err := c.RunBulkQuery(ctx, query)
+	if err != nil {
+		return err
+	}
+	op, err = c.waitOrCancel(ctx, op, opts)
+	if err != nil {
+		return err
+	}
+	// operations without any result have no file
+	if op.URL == "" {
+		return nil
+	}
+	return c.StreamBulkResults(ctx, op.URL, fn)
+}
+
+// CancelBulkOperation asks shopify to cancel the running bulk operation id,
+// the operation stops once its status becomes CANCELED
+func (c *Client) CancelBulkOperation(ctx context.Context, id string) (*BulkOperation, error) {
+	mutation := `mutation ($id: ID!) {
+		bulkOperationCancel(id: $id) {
+			bulkOperation { ` + bulkOperationFields + ` }
+			userErrors { field message }
+		}
+	}`
+	result := struct {
+		BulkOperationCancel struct {
+			BulkOperation *BulkOperation `json:"bulkOperation"`
+		} `json:"bulkOperationCancel"`
+	}{}
+	if err := c.GraphqlInto(ctx, mutation, map[string]any{"id": id}, &result); err != nil {
+		return nil, err
+	}
+	if result.BulkOperationCancel.BulkOperation == nil {
+		return nil, ErrNoGraphqlData
+	}
+	return result.BulkOperationCancel.BulkOperation, nil
+}
+
+// waitOrCancel waits for op like WaitBulkOperation, and cancels it on shopify when ctx ends first
+// so it doesn't block the next operation of the shop
+func (c *Client) waitOrCancel(ctx context.Context, op *BulkOperation, opts BulkWaitOptions) (*BulkOperation, error) {
+	done, err := c.WaitBulkOperation(ctx, op, opts)
+	if err != nil && ctx.Err() != nil {
+		cancelCtx, cancel := context.WithTimeout(context.Background(), bulkCancelTimeout)
+		defer cancel()
+		c.CancelBulkOperation(cancelCtx, op.ID)
+	}
+	return done, err
+}
+
+// BulkVariables returns the variables of the next mutation of a bulk mutation, and io.EOF once there are no more
+type BulkVariables func() (map[string]any, error)
+
+// BulkMutationResult is the outcome of the mutation ran with one line of variables
+type BulkMutationResult struct {
+	Line       int             // index of the variables the mutation ran with
+	Data       json.RawMessage // the mutation response data
+	Errors     []GraphqlError
+	UserErrors []UserError
+}
+
+type stagedUploadParameter struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// stagedUpload uploads the JSONL variables file of a bulk mutation and returns its staged upload path
+func (c *Client) stagedUpload(ctx context.Context, filename string, content []byte) (string, error) {
+	mutation := `mutation ($input: [StagedUploadInput!]!) {
+		stagedUploadsCreate(input: $input) {
+			stagedTargets { url resourceUrl parameters { name value } }
+			userErrors { field message }
+		}
+	}`
+	input := []map[string]any{{
+		"resource":   "BULK_MUTATION_VARIABLES",
+		"filename":   filename,
+		"mimeType":   "text/jsonl",
+		"httpMethod": http.MethodPost,
+	}}
+	result := struct {
+		StagedUploadsCreate struct {
+			StagedTargets []struct {
+				URL        string                  `json:"url"`
+				Parameters []stagedUploadParameter `json:"parameters"`
+			} `json:"stagedTargets"`
+		} `json:"stagedUploadsCreate"`
+	}{}
+	if err := c.GraphqlInto(ctx, mutation, map[string]any{"input": input}, &result); err != nil {
+		return "", err
+	}
+	if len(result.StagedUploadsCreate.StagedTargets) == 0 {
+		return "", ErrNoGraphqlData
+	}
+	target := result.StagedUploadsCreate.StagedTargets[0]
+
+	// the upload target expects its parameters as form fields before the file
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	path := ""
+	for _, p := range target.Parameters {
+		if p.Name == "key" {
+			path = p.Value
+		}
+		if err := form.WriteField(p.Name, p.Value); err != nil {
+			return "", err
+		}
+	}
+	file, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Write(content); err != nil {
+		return "", err
+	}
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+	if path == "" {
+		return "", errors.New("staged upload target has no key parameter")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.URL, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	res, err := (&http.Client{Transport: c.client.Transport}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= http.StatusMultipleChoices {
+		return "", fmt.Errorf("staged upload failed: %s", res.Status)
+	}
+	return path, nil
+}
+
+// RunBulkMutation submits mutation as a bulk operation ran once for every line of the staged variables file
+func (c *Client) RunBulkMutation(ctx context.Context, mutation string, stagedUploadPath string) (*BulkOperation, error) {
+	query := `mutation ($mutation: String!, $path: String!) {
+		bulkOperationRunMutation(mutation: $mutation, stagedUploadPath: $path) {
+			bulkOperation { ` + bulkOperationFields + ` }
+			userErrors { field message code }
+		}
+	}`
+	result := struct {
+		BulkOperationRunMutation struct {
+			BulkOperation *BulkOperation `json:"bulkOperation"`
+		} `json:"bulkOperationRunMutation"`
+	}{}
+	if err := c.GraphqlInto(ctx, query, map[string]any{"mutation": mutation, "path": stagedUploadPath}, &result); err != nil {
+		return nil, err
+	}
+	if result.BulkOperationRunMutation.BulkOperation == nil {
+		return nil, ErrNoGraphqlData
+	}
+	return result.BulkOperationRunMutation.BulkOperation, nil
+}
+
+// BulkMutate runs mutation once for every variables returned by next as a bulk operation,
+// it uploads the variables, waits for the operation to complete and returns the result of every line.
+// The operation is canceled on shopify when ctx ends before it completes.
+// It returns ErrBulkVariablesTooLarge, before uploading anything, when the variables file would exceed shopify's 100MB limit.
+func (c *Client) BulkMutate(ctx context.Context, mutation string, next BulkVariables, opts BulkWaitOptions) ([]BulkMutationResult, error) {
+	var content bytes.Buffer
+	enc := json.NewEncoder(&content)
+	for line := 0; ; {
+		vars, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := enc.Encode(vars); err != nil {
+			return nil, err
+		}
+		if content.Len() > maxBulkVariablesSize {
+			return nil, fmt.Errorf("%w: %d bytes after line %d, the limit is %d bytes",
+				ErrBulkVariablesTooLarge, content.Len(), line, maxBulkVariablesSize)
+		}
+		line++
+	}
+
+	path, err := c.stagedUpload(ctx, "bulk_variables.jsonl", content.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	op, err := c.RunBulkMutation(ctx, mutation, path)
+	if err != nil {
+		return nil, err
+	}
+	if op.Type == "" {
+		op.Type = BulkMutation
+	}
+	op, err = c.waitOrCancel(ctx, op, opts)
+	if err != nil {
+		return nil, err
+	}
+	if op.URL == "" {
+		return nil, nil
+	}
+
+	var results []BulkMutationResult
+	err = c.StreamBulkResults(ctx, op.URL, func(obj *BulkObject) error {
+		line := struct {
+			Data   json.RawMessage `json:"data"`
+			Line   int             `json:"__lineNumber"`
+			Errors []GraphqlError  `json:"errors"`
+		}{}
+		if err := obj.Decode(&line); err != nil {
+			return err
+		}
+		results = append(results, BulkMutationResult{
+			Line:       line.Line,
+			Data:       line.Data,
+			Errors:     line.Errors,
+			UserErrors: collectUserErrors(line.Data),
+		})
+		return nil
+	})
+	return results, err
+}
@@ -0,0 +1,238 @@
+package gopify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBulkQuery(t *testing.T) {
+	polls := 0
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/results.jsonl" {
+			fmt.Fprint(w, `{"id":"gid://shopify/Product/1","title":"Product 1"}
+{"id":"gid://shopify/ProductVariant/1","title":"Small","__parentId":"gid://shopify/Product/1"}
+{"id":"gid://shopify/ProductVariant/2","title":"Large","__parentId":"gid://shopify/Product/1"}
+{"id":"gid://shopify/Product/2","title":"Product 2"}
+`)
+			return
+		}
+		body := struct {
+			Query     string         `json:"query"`
+			Variables map[string]any `json:"variables"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch {
+		case strings.Contains(body.Query, "bulkOperationRunQuery"):
+			fmt.Fprint(w, `{"data":{"bulkOperationRunQuery":{"bulkOperation":{"id":"gid://shopify/BulkOperation/1","status":"CREATED","type":"QUERY"},"userErrors":[]}}}`)
+		case strings.Contains(body.Query, "currentBulkOperation"):
+			polls++
+			if polls == 1 {
+				fmt.Fprint(w, `{"data":{"currentBulkOperation":{"id":"gid://shopify/BulkOperation/1","status":"RUNNING","type":"QUERY"}}}`)
+				return
+			}
+			fmt.Fprintf(w, `{"data":{"currentBulkOperation":{"id":"gid://shopify/BulkOperation/1","status":"COMPLETED","type":"QUERY","url":"%s/results.jsonl"}}}`, ts.URL)
+		}
+	}))
+	defer ts.Close()
+
+	apiClient := NewClient(ts.URL[7:], "access token")
+	apiClient.baseUrl = fmt.Sprintf("%s/admin/api/%s", ts.URL, apiClient.version)
+
+	notify := make(chan struct{}, 1)
+	notify <- struct{}{}
+	type product struct {
+		Title string `json:"title"`
+	}
+	results := []string{}
+	opts := BulkWaitOptions{PollInterval: time.Minute, Notify: notify}
+	err := apiClient.BulkQuery(context.Background(), "{ products { edges { node { id title variants { edges { node { id title } } } } } } }", opts, func(obj *BulkObject) error {
+		p := product{}
+		if err := obj.Decode(&p); err != nil {
+			return err
+		}
+		variants := []string{}
+		for _, child := range obj.Children {
+			v := product{}
+			if err := child.Decode(&v); err != nil {
+				return err
+			}
+			variants = append(variants, v.Title)
+		}
+		results = append(results, fmt.Sprintf("%s%v", p.Title, variants))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if fmt.Sprint(results) != "[Product 1[Small Large] Product 2[]]" {
+		t.Errorf("unexpected results %v", results)
+	}
+	if polls != 2 {
+		t.Errorf("expected 2 polls got %d", polls)
+	}
+}
+
+func TestBulkQueryCancel(t *testing.T) {
+	canceled := ""
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := struct {
+			Query     string         `json:"query"`
+			Variables map[string]any `json:"variables"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch {
+		case strings.Contains(body.Query, "bulkOperationRunQuery"):
+			fmt.Fprint(w, `{"data":{"bulkOperationRunQuery":{"bulkOperation":{"id":"gid://shopify/BulkOperation/1","status":"CREATED","type":"QUERY"},"userErrors":[]}}}`)
+		case strings.Contains(body.Query, "currentBulkOperation"):
+			fmt.Fprint(w, `{"data":{"currentBulkOperation":{"id":"gid://shopify/BulkOperation/1","status":"RUNNING","type":"QUERY"}}}`)
+		case strings.Contains(body.Query, "bulkOperationCancel"):
+			canceled = fmt.Sprint(body.Variables["id"])
+			fmt.Fprint(w, `{"data":{"bulkOperationCancel":{"bulkOperation":{"id":"gid://shopify/BulkOperation/1","status":"CANCELING","type":"QUERY"},"userErrors":[]}}}`)
+		}
+	}))
+	defer ts.Close()
+
+	apiClient := NewClient(ts.URL[7:], "access token")
+	apiClient.baseUrl = fmt.Sprintf("%s/admin/api/%s", ts.URL, apiClient.version)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := apiClient.BulkQuery(ctx, "{ products { edges { node { id } } } }", BulkWaitOptions{PollInterval: time.Millisecond}, func(obj *BulkObject) error {
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected error %v got %v", context.DeadlineExceeded, err)
+	}
+	if canceled != "gid://shopify/BulkOperation/1" {
+		t.Errorf("expected the operation to be canceled on shopify got %q", canceled)
+	}
+}
+
+func TestWaitBulkOperationFailed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data":{"currentBulkOperation":{"id":"gid://shopify/BulkOperation/1","status":"FAILED","errorCode":"INTERNAL_SERVER_ERROR","type":"QUERY"}}}`)
+	}))
+	defer ts.Close()
+
+	apiClient := NewClient(ts.URL[7:], "access token")
+	apiClient.baseUrl = fmt.Sprintf("%s/admin/api/%s", ts.URL, apiClient.version)
+
+	op, err := apiClient.WaitBulkOperation(context.Background(), &BulkOperation{ID: "gid://shopify/BulkOperation/1"}, BulkWaitOptions{})
+	if !errors.Is(err, ErrBulkOperationFailed) {
+		t.Errorf("expected error %v got %v", ErrBulkOperationFailed, err)
+	}
+	if op == nil || op.ErrorCode != "INTERNAL_SERVER_ERROR" {
+		t.Errorf("expected the failed operation to be returned got %v", op)
+	}
+}
+
+func TestBulkMutate(t *testing.T) {
+	uploaded := ""
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/upload":
+			if r.FormValue("key") != "tmp/bulk_variables.jsonl" || r.FormValue("policy") != "signed" {
+				t.Errorf("expected the staged upload parameters got %v", r.MultipartForm)
+			}
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				t.Fatalf("expected a file got %v", err)
+			}
+			b, _ := io.ReadAll(file)
+			uploaded = string(b)
+			w.WriteHeader(http.StatusCreated)
+			return
+		case "/results.jsonl":
+			fmt.Fprint(w, `{"data":{"productUpdate":{"product":{"id":"gid://shopify/Product/1"},"userErrors":[]}},"__lineNumber":0}
+{"data":{"productUpdate":{"product":null,"userErrors":[{"field":["input","title"],"message":"Title can't be blank"}]}},"__lineNumber":1}
+`)
+			return
+		}
+		body := struct {
+			Query     string         `json:"query"`
+			Variables map[string]any `json:"variables"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch {
+		case strings.Contains(body.Query, "stagedUploadsCreate"):
+			fmt.Fprintf(w, `{"data":{"stagedUploadsCreate":{"stagedTargets":[{"url":"%s/upload","parameters":[{"name":"key","value":"tmp/bulk_variables.jsonl"},{"name":"policy","value":"signed"}]}],"userErrors":[]}}}`, ts.URL)
+		case strings.Contains(body.Query, "bulkOperationRunMutation"):
+			if body.Variables["path"] != "tmp/bulk_variables.jsonl" {
+				t.Errorf("expected the staged upload path got %v", body.Variables["path"])
+			}
+			fmt.Fprint(w, `{"data":{"bulkOperationRunMutation":{"bulkOperation":{"id":"gid://shopify/BulkOperation/2","status":"CREATED","type":"MUTATION"},"userErrors":[]}}}`)
+		case strings.Contains(body.Query, "currentBulkOperation"):
+			if body.Variables["type"] != BulkMutation {
+				t.Errorf("expected a mutation operation to be polled got %v", body.Variables["type"])
+			}
+			fmt.Fprintf(w, `{"data":{"currentBulkOperation":{"id":"gid://shopify/BulkOperation/2","status":"COMPLETED","type":"MUTATION","url":"%s/results.jsonl"}}}`, ts.URL)
+		}
+	}))
+	defer ts.Close()
+
+	apiClient := NewClient(ts.URL[7:], "access token")
+	apiClient.baseUrl = fmt.Sprintf("%s/admin/api/%s", ts.URL, apiClient.version)
+
+	titles := []string{"Product 1", ""}
+	i := 0
+	next := func() (map[string]any, error) {
+		if i == len(titles) {
+			return nil, io.EOF
+		}
+		i++
+		return map[string]any{"input": map[string]any{"id": fmt.Sprintf("gid://shopify/Product/%d", i), "title": titles[i-1]}}, nil
+	}
+	mutation := "mutation ($input: ProductInput!) { productUpdate(input: $input) { product { id } userErrors { field message } } }"
+	results, err := apiClient.BulkMutate(context.Background(), mutation, next, BulkWaitOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	expectedUpload := `{"input":{"id":"gid://shopify/Product/1","title":"Product 1"}}
+{"input":{"id":"gid://shopify/Product/2","title":""}}
+`
+	if uploaded != expectedUpload {
+		t.Errorf("unexpected uploaded variables %q", uploaded)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results got %d", len(results))
+	}
+	if len(results[0].UserErrors) != 0 || results[1].Line != 1 || len(results[1].UserErrors) != 1 {
+		t.Errorf("unexpected results %+v", results)
+	}
+}
+
+func TestBulkMutateTooLarge(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to %s", r.URL.Path)
+	}))
+	defer ts.Close()
+	defer func(size int) { maxBulkVariablesSize = size }(maxBulkVariablesSize)
+	maxBulkVariablesSize = 100
+
+	apiClient := NewClient(ts.URL[7:], "access token")
+	apiClient.baseUrl = fmt.Sprintf("%s/admin/api/%s", ts.URL, apiClient.version)
+	calls := 0
+	next := func() (map[string]any, error) {
+		calls++
+		return map[string]any{"input": map[string]any{"title": strings.Repeat("a", 40)}}, nil
+	}
+	_, err := apiClient.BulkMutate(context.Background(), "mutation", next, BulkWaitOptions{})
+	if !errors.Is(err, ErrBulkVariablesTooLarge) {
+		t.Errorf("expected error %v got %v", ErrBulkVariablesTooLarge, err)
+	}
+	// the variables stop being read once the limit is exceeded
+	if calls != 2 {
+		t.Errorf("expected 2 variables to be read got %d", calls)
+	}
+}
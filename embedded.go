@@ -0,0 +1,82 @@
+package gopify
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+)
+
+const (
+	// RetryInvalidSessionHeader tells App Bridge to fetch a new session token and retry the request
+	RetryInvalidSessionHeader = "X-Shopify-Retry-Invalid-Session-Request"
+	// idTokenParam is the query parameter Shopify sends the session token in on document requests
+	idTokenParam = "id_token"
+	// reloadParam is the url the bounce page reloads with a fresh session token
+	reloadParam  = "shopify-reload"
+	appBridgeUrl = "https://cdn.shopify.com/shopifycloud/app-bridge.js"
+)
+
+// BouncePage is a handler that serves a page loading App Bridge, which gets a new session token
+// and reloads the url in the shopify-reload query parameter with it. Mount it on the bouncePath given to EmbeddedApp.
+func (g *Gopify) BouncePage() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, `<script data-api-key="%s" src="%s"></script>`, html.EscapeString(g.ApiKey), appBridgeUrl)
+	})
+}
+
+// EmbeddedApp returns a middleware that verifies the session token of requests from an embedded app,
+// and stores its payload in the request context like VerifyToken.
+//
+// Fetch requests carry the token in the Authorization header, an invalid or expired token gets a 401
+// with the X-Shopify-Retry-Invalid-Session-Request header so App Bridge retries with a new token.
+// Document requests carry it in the id_token query parameter, when it's missing or invalid the request
+// is redirected to bouncePath, served by BouncePage, which reloads the page with a new token.
+func (g *Gopify) EmbeddedApp(bouncePath string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := tokenFromHeader(r); token != "" {
+			payload, err := g.DecodeSessionToken(token)
+			if err != nil {
+				if tokenErrorStatus(err) == http.StatusInternalServerError {
+					tokenError(w, err)
+					return
+				}
+				w.Header().Set(RetryInvalidSessionHeader, "1")
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), PayloadCtxKey, payload)))
+			return
+		}
+
+		query := r.URL.Query()
+		if token := query.Get(idTokenParam); token != "" {
+			payload, err := g.DecodeSessionToken(token)
+			if err == nil {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), PayloadCtxKey, payload)))
+				return
+			}
+			if tokenErrorStatus(err) == http.StatusInternalServerError {
+				tokenError(w, err)
+				return
+			}
+		}
+
+		// bounce the document request so App Bridge reloads it with a new session token
+		shop := query.Get("shop")
+		if !ValidShop(shop) {
+			http.Error(w, ErrInvalidShop.Error(), http.StatusBadRequest)
+			return
+		}
+		query.Del(idTokenParam)
+		reload := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+		bounce := url.Values{
+			"shop":      {shop},
+			"host":      {query.Get("host")},
+			reloadParam: {reload.String()},
+		}
+		http.Redirect(w, r, bouncePath+"?"+bounce.Encode(), http.StatusFound)
+	})
+}
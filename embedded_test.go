@@ -0,0 +1,71 @@
+package gopify
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestEmbeddedApp(t *testing.T) {
+	gopify := Gopify{ApiKey: "key", ApiSecret: "hush"}
+	validToken := createToken(false, gopify.ApiKey, gopify.ApiSecret)
+	expiredToken := createToken(true, gopify.ApiKey, gopify.ApiSecret)
+
+	h := gopify.EmbeddedApp("/bounce", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p, ok := PayloadFromContext(r.Context()); !ok || p.Shop() != "shop-name.myshopify.com" {
+			t.Errorf("expected the token payload in the context got %v", p)
+		}
+	}))
+
+	cases := []struct {
+		url      string
+		bearer   string
+		expected int
+		retry    bool
+		bounce   string
+	}{
+		{"/app", validToken, http.StatusOK, false, ""},
+		{"/app", expiredToken, http.StatusUnauthorized, true, ""},
+		{"/app", "a.b", http.StatusUnauthorized, true, ""},
+		{"/app?shop=shop-name.myshopify.com&id_token=" + validToken, "", http.StatusOK, false, ""},
+		{"/app?shop=shop-name.myshopify.com&host=aG9zdA&id_token=" + expiredToken, "", http.StatusFound, false, "/app?host=aG9zdA&shop=shop-name.myshopify.com"},
+		{"/app?shop=shop-name.myshopify.com", "", http.StatusFound, false, "/app?shop=shop-name.myshopify.com"},
+		{"/app", "", http.StatusBadRequest, false, ""},
+	}
+
+	for i, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, c.url, nil)
+		if c.bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+c.bearer)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		res := rec.Result()
+
+		if res.StatusCode != c.expected {
+			t.Errorf("case %d expected %d status code but got %d", i, c.expected, res.StatusCode)
+		}
+		if (res.Header.Get(RetryInvalidSessionHeader) == "1") != c.retry {
+			t.Errorf("case %d unexpected retry header %q", i, res.Header.Get(RetryInvalidSessionHeader))
+		}
+		if c.bounce != "" {
+			location, _ := url.Parse(res.Header.Get("Location"))
+			if location.Path != "/bounce" || location.Query().Get("shopify-reload") != c.bounce {
+				t.Errorf("case %d expected a bounce reloading %s got %s", i, c.bounce, location)
+			}
+		}
+	}
+}
+
+func TestBouncePage(t *testing.T) {
+	gopify := Gopify{ApiKey: "key"}
+	rec := httptest.NewRecorder()
+	gopify.BouncePage().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/bounce?shopify-reload=/app", nil))
+
+	body := rec.Body.String()
+	if !strings.Contains(body, `data-api-key="key"`) || !strings.Contains(body, appBridgeUrl) {
+		t.Errorf("expected a page loading app bridge got %s", body)
+	}
+}
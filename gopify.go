@@ -8,33 +8,55 @@ import (
 	"errors"
 	"net/http"
 	"net/url"
+	"regexp"
 )
 
 var (
 	ErrUnauthorizedRequest = errors.New("unauthorized request")
 )
 
+var shopDomainRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9-]*\.myshopify\.com$`)
+
 // Gopify holds common shopify app settings
 type Gopify struct {
 	ApiKey      string
 	ApiSecret   string
 	RedirectUrl string
 	Scopes      []string
+	// HttpClient is used for requests to shopify's oauth endpoints, http.DefaultClient is used when nil
+	HttpClient *http.Client
+	// ExpiringOfflineTokens requests offline access tokens that expire and come with a refresh token
+	ExpiringOfflineTokens bool
+	// TokenVerifier configures session token verification, tokens are checked without leeway nor replay cache when nil
+	TokenVerifier *TokenVerifier
+	// OldApiSecrets are previous app secrets still accepted for webhooks, so the secret can be rotated
+	// without rejecting webhooks signed with the old one
+	OldApiSecrets []string
+	// MaxWebhookBodySize is the maximum size in bytes of a webhook body, 10MB is used when zero
+	MaxWebhookBodySize int64
+}
+
+func (g *Gopify) httpClient() *http.Client {
+	if g.HttpClient != nil {
+		return g.HttpClient
+	}
+	return http.DefaultClient
+}
+
+// ValidShop reports whether shop is a valid shop domain like example.myshopify.com
+func ValidShop(shop string) bool {
+	return shopDomainRegex.MatchString(shop)
 }
 
 // VerifyRequest verifies the authenticity of the request from Shopify
 func (g *Gopify) VerifyRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		q := r.URL.Query()
-		mac, err := hex.DecodeString(q.Get("hmac"))
+		valid, err := g.validQueryHmac(r.URL.Query())
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		q.Del("hmac")
-		message, _ := url.QueryUnescape(q.Encode())
-
-		if !g.ValidHmac(mac, message) {
+		if !valid {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
@@ -49,3 +71,14 @@ func (g *Gopify) ValidHmac(mac []byte, message string) bool {
 	validMac := hasher.Sum(nil)
 	return hmac.Equal(mac, validMac)
 }
+
+// validQueryHmac checks the hmac parameter of a query string sent by shopify
+func (g *Gopify) validQueryHmac(q url.Values) (bool, error) {
+	mac, err := hex.DecodeString(q.Get("hmac"))
+	if err != nil {
+		return false, err
+	}
+	q.Del("hmac")
+	message, _ := url.QueryUnescape(q.Encode())
+	return g.ValidHmac(mac, message), nil
+}
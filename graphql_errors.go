@@ -0,0 +1,137 @@
+package gopify
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// graphql error codes returned by shopify in the error extensions
+const (
+	GraphqlThrottled       = "THROTTLED"
+	GraphqlMaxCostExceeded = "MAX_COST_EXCEEDED"
+	GraphqlAccessDenied    = "ACCESS_DENIED"
+)
+
+// GraphqlErrorLocation points to the part of the query document an error is about
+type GraphqlErrorLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// GraphqlError is a single entry of the errors array of a graphql response
+type GraphqlError struct {
+	Message    string                 `json:"message"`
+	Path       []any                  `json:"path"`
+	Locations  []GraphqlErrorLocation `json:"locations"`
+	Extensions map[string]any         `json:"extensions"`
+}
+
+func (err GraphqlError) Error() string {
+	return err.Message
+}
+
+// Code returns the error code from the error extensions, or an empty string if there is none
+func (err GraphqlError) Code() string {
+	code, _ := err.Extensions["code"].(string)
+	return code
+}
+
+// Throttled reports whether the query was rejected because of its cost
+func (err GraphqlError) Throttled() bool {
+	code := err.Code()
+	return code == GraphqlThrottled || code == GraphqlMaxCostExceeded
+}
+
+// AccessDenied reports whether the app lacks the scopes needed by the query
+func (err GraphqlError) AccessDenied() bool {
+	return err.Code() == GraphqlAccessDenied
+}
+
+// Validation reports whether the query document itself is invalid, like an unknown field or a missing argument
+func (err GraphqlError) Validation() bool {
+	return len(err.Locations) > 0 && !err.Throttled() && !err.AccessDenied()
+}
+
+// UserError is an entry of the userErrors field returned by mutations
+type UserError struct {
+	Field   []string `json:"field"`
+	Message string   `json:"message"`
+	Code    string   `json:"code"`
+}
+
+// GraphqlErrors holds every error returned by a graphql call,
+// it can be extracted from the returned error with errors.As
+type GraphqlErrors struct {
+	Errors     []GraphqlError
+	UserErrors []UserError
+}
+
+func (errs GraphqlErrors) Error() string {
+	messages := make([]string, 0, len(errs.Errors)+len(errs.UserErrors))
+	for _, err := range errs.Errors {
+		messages = append(messages, err.Message)
+	}
+	for _, err := range errs.UserErrors {
+		if len(err.Field) > 0 {
+			messages = append(messages, fmt.Sprintf("%s: %s", strings.Join(err.Field, "."), err.Message))
+		} else {
+			messages = append(messages, err.Message)
+		}
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Is makes errors.Is(err, ErrRateLimit) true for throttled queries
+func (errs GraphqlErrors) Is(target error) bool {
+	return target == ErrRateLimit && errs.Throttled()
+}
+
+// Throttled reports whether any of the errors is a throttling error
+func (errs GraphqlErrors) Throttled() bool {
+	for _, err := range errs.Errors {
+		if err.Throttled() {
+			return true
+		}
+	}
+	return false
+}
+
+// AccessDenied reports whether any of the errors is an access denied error
+func (errs GraphqlErrors) AccessDenied() bool {
+	for _, err := range errs.Errors {
+		if err.AccessDenied() {
+			return true
+		}
+	}
+	return false
+}
+
+// Validation reports whether any of the errors is a query validation error
+func (errs GraphqlErrors) Validation() bool {
+	for _, err := range errs.Errors {
+		if err.Validation() {
+			return true
+		}
+	}
+	return false
+}
+
+// collectUserErrors gathers the userErrors of every mutation payload in data
+func collectUserErrors(data json.RawMessage) []UserError {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil
+	}
+	var userErrors []UserError
+	for _, field := range fields {
+		payload := struct {
+			UserErrors []UserError `json:"userErrors"`
+		}{}
+		if err := json.Unmarshal(field, &payload); err != nil {
+			continue
+		}
+		userErrors = append(userErrors, payload.UserErrors...)
+	}
+	return userErrors
+}
@@ -0,0 +1,78 @@
+package gopify
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGraphqlErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{
+			"data": {"shop": {"name": "test", "orders": null}},
+			"errors": [
+				{"message": "Access denied for orders field.", "path": ["shop", "orders"], "extensions": {"code": "ACCESS_DENIED"}},
+				{"message": "Field 'foo' doesn't exist on type 'Shop'", "locations": [{"line": 1, "column": 10}], "path": ["query", "shop", "foo"], "extensions": {"code": "undefinedField"}}
+			]
+		}`)
+	}))
+	defer ts.Close()
+
+	apiClient := NewClient(ts.URL[7:], "access token")
+	apiClient.baseUrl = fmt.Sprintf("%s/admin/api/%s", ts.URL, apiClient.version)
+	data, err := apiClient.Graphql("{ shop { name orders foo } }", nil)
+
+	var errs GraphqlErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected a GraphqlErrors got %v", err)
+	}
+	if len(errs.Errors) != 2 {
+		t.Fatalf("expected 2 errors got %d", len(errs.Errors))
+	}
+	if !errs.Errors[0].AccessDenied() || errs.Errors[0].Validation() {
+		t.Errorf("expected the first error to be an access denied error")
+	}
+	if fmt.Sprint(errs.Errors[0].Path) != "[shop orders]" {
+		t.Errorf("unexpected error path %v", errs.Errors[0].Path)
+	}
+	if !errs.Errors[1].Validation() || errs.Errors[1].Locations[0] != (GraphqlErrorLocation{Line: 1, Column: 10}) {
+		t.Errorf("expected the second error to be a validation error at 1:10")
+	}
+	if errs.Throttled() || errors.Is(err, ErrRateLimit) {
+		t.Errorf("errors are not throttling errors")
+	}
+	if fmt.Sprint(data) != "map[shop:map[name:test orders:<nil>]]" {
+		t.Errorf("expected partial data got %v", data)
+	}
+}
+
+func TestGraphqlUserErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": {"productUpdate": {"product": null, "userErrors": [{"field": ["input", "title"], "message": "Title can't be blank"}]}}}`)
+	}))
+	defer ts.Close()
+
+	apiClient := NewClient(ts.URL[7:], "access token")
+	apiClient.baseUrl = fmt.Sprintf("%s/admin/api/%s", ts.URL, apiClient.version)
+	_, err := apiClient.Graphql("mutation { productUpdate(input: {title: \"\"}) { product { id } userErrors { field message } } }", nil)
+
+	var errs GraphqlErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected a GraphqlErrors got %v", err)
+	}
+	if len(errs.UserErrors) != 1 || errs.UserErrors[0].Message != "Title can't be blank" {
+		t.Errorf("unexpected user errors %v", errs.UserErrors)
+	}
+	if err.Error() != "input.title: Title can't be blank" {
+		t.Errorf("unexpected error message %q", err.Error())
+	}
+}
+
+func TestGraphqlErrorsThrottled(t *testing.T) {
+	err := error(GraphqlErrors{Errors: []GraphqlError{{Message: "Query cost is 2000", Extensions: map[string]any{"code": "MAX_COST_EXCEEDED"}}}})
+	if !errors.Is(err, ErrRateLimit) {
+		t.Errorf("expected a max cost error to be a rate limit error")
+	}
+}
@@ -2,50 +2,311 @@ package gopify
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
+// TokenType is the type of access token requested with ExchangeSessionToken
+type TokenType string
+
+const (
+	OnlineAccessToken  TokenType = "urn:shopify:params:oauth:token-type:online-access-token"
+	OfflineAccessToken TokenType = "urn:shopify:params:oauth:token-type:offline-access-token"
+)
+
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	idTokenType            = "urn:ietf:params:oauth:token-type:id_token"
+)
+
+const (
+	stateCookieName = "gopify_oauth_state"
+	stateSize       = 32
+	stateMaxAge     = 10 * time.Minute
+)
+
+var (
+	ErrInvalidShop  = errors.New("invalid shop domain")
+	ErrInvalidState = errors.New("invalid oauth state")
+)
+
+// AuthOption configures the authorization url
+type AuthOption func(q url.Values)
+
+// WithOnlineAccess requests an online access token tied to the user who authorizes the app
+func WithOnlineAccess() AuthOption {
+	return func(q url.Values) {
+		q.Set("grant_options[]", "per-user")
+	}
+}
+
 // AuthorizationUrl returns a URL to shopify's consent page that asks for permissions
 // for the required scopes.
-func (g *Gopify) AuthorizationUrl(shop string, state string) string {
+func (g *Gopify) AuthorizationUrl(shop string, state string, opts ...AuthOption) string {
 	query := url.Values{
 		"client_id":    {g.ApiKey},
 		"redirect_uri": {g.RedirectUrl},
 		"scope":        {strings.Join(g.Scopes, ",")},
 		"state":        {state},
 	}
+	for _, opt := range opts {
+		opt(query)
+	}
 	return fmt.Sprintf("https://%s/admin/oauth/authorize?%s", shop, query.Encode())
 }
 
-// AccessToken retrieves an access token from shopify authorization server
+// AssociatedUser is the shopify user an online access token was granted for
+type AssociatedUser struct {
+	ID            int64  `json:"id"`
+	FirstName     string `json:"first_name"`
+	LastName      string `json:"last_name"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	AccountOwner  bool   `json:"account_owner"`
+	Locale        string `json:"locale"`
+	Collaborator  bool   `json:"collaborator"`
+}
+
+// AccessTokenResponse is the response of shopify's access token endpoint
+type AccessTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	Scope       string `json:"scope"`
+	// ExpiresIn is the lifetime of the token in seconds, 0 for offline tokens that don't expire
+	ExpiresIn           int             `json:"expires_in"`
+	AssociatedUserScope string          `json:"associated_user_scope"`
+	AssociatedUser      *AssociatedUser `json:"associated_user"`
+	// RefreshToken is only set for expiring offline tokens
+	RefreshToken          string `json:"refresh_token"`
+	RefreshTokenExpiresIn int    `json:"refresh_token_expires_in"`
+}
+
+// Scopes returns the granted scopes
+func (res *AccessTokenResponse) Scopes() []string {
+	return splitScopes(res.Scope)
+}
+
+// Online reports whether the token is an online access token
+func (res *AccessTokenResponse) Online() bool {
+	return res.AssociatedUser != nil
+}
+
+// TokenError is an error returned by shopify's access token endpoint
+type TokenError struct {
+	StatusCode  int
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (err TokenError) Error() string {
+	if err.Code == "" {
+		return fmt.Sprintf("access token request failed: %s", http.StatusText(err.StatusCode))
+	}
+	if err.Description == "" {
+		return fmt.Sprintf("access token request failed: %s", err.Code)
+	}
+	return fmt.Sprintf("access token request failed: %s: %s", err.Code, err.Description)
+}
+
+func splitScopes(scope string) []string {
+	scopes := []string{}
+	for _, s := range strings.Split(scope, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// AccessToken retrieves an access token from shopify authorization server,
+// it returns ErrInvalidShop if shop isn't a valid shop domain
 //
 // code is The authorization code obtained by using an authorization server
-func (g *Gopify) AccessToken(shop string, code string) (string, error) {
+func (g *Gopify) AccessToken(shop string, code string) (*AccessTokenResponse, error) {
+	return g.AccessTokenCtx(context.Background(), shop, code)
+}
+
+// AccessTokenCtx is like AccessToken but uses ctx for the token request
+func (g *Gopify) AccessTokenCtx(ctx context.Context, shop string, code string) (*AccessTokenResponse, error) {
+	params := map[string]string{
+		"code": code,
+	}
+	if g.ExpiringOfflineTokens {
+		params["expiring"] = "1"
+	}
+	return g.requestAccessToken(ctx, shop, params)
+}
+
+// RefreshAccessToken exchanges the refresh token of an expiring offline token for a new access token and refresh token
+func (g *Gopify) RefreshAccessToken(ctx context.Context, shop string, refreshToken string) (*AccessTokenResponse, error) {
+	return g.requestAccessToken(ctx, shop, map[string]string{
+		"grant_type":    "refresh_token",
+		"refresh_token": refreshToken,
+	})
+}
+
+// ClientCredentialsToken gets an access token for shop with the client credentials grant,
+// which is only available to apps owned by the same organization as the shop
+func (g *Gopify) ClientCredentialsToken(ctx context.Context, shop string) (*AccessTokenResponse, error) {
+	return g.requestAccessToken(ctx, shop, map[string]string{
+		"grant_type": "client_credentials",
+	})
+}
+
+// ExchangeSessionToken exchanges a session token of an embedded app for an online or offline access token,
+// which lets apps installed by shopify skip the redirect based oauth flow.
+//
+// shopify verifies the session token itself, but it should have been verified by VerifyToken
+// before trusting the shop it was issued for.
+func (g *Gopify) ExchangeSessionToken(ctx context.Context, shop string, sessionToken string, tokenType TokenType) (*AccessTokenResponse, error) {
+	params := map[string]string{
+		"grant_type":           tokenExchangeGrantType,
+		"subject_token":        sessionToken,
+		"subject_token_type":   idTokenType,
+		"requested_token_type": string(tokenType),
+	}
+	if g.ExpiringOfflineTokens && tokenType == OfflineAccessToken {
+		params["expiring"] = "1"
+	}
+	return g.requestAccessToken(ctx, shop, params)
+}
+
+// requestAccessToken posts params along with the app credentials to the access token endpoint of shop.
+// The shop domain is validated first so the app secret is only ever sent to shopify.
+func (g *Gopify) requestAccessToken(ctx context.Context, shop string, params map[string]string) (*AccessTokenResponse, error) {
+	if !ValidShop(shop) {
+		return nil, ErrInvalidShop
+	}
 	accessTokenPath := "admin/oauth/access_token"
 	accessTokenEndPoint := fmt.Sprintf("https://%s/%s", shop, accessTokenPath)
-	requestParams, err := json.Marshal(map[string]string{
+	body := map[string]string{
 		"client_id":     g.ApiKey,
 		"client_secret": g.ApiSecret,
-		"code":          code,
-	})
+	}
+	for k, v := range params {
+		body[k] = v
+	}
+	requestParams, err := json.Marshal(body)
 	if err != nil {
-		return "", nil
+		return nil, err
 	}
 
-	res, err := http.Post(accessTokenEndPoint, "application/json", bytes.NewBuffer(requestParams))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, accessTokenEndPoint, bytes.NewBuffer(requestParams))
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	res, err := g.httpClient().Do(req)
+	if err != nil {
+		return nil, err
 	}
 	defer res.Body.Close()
 
-	resPayload := map[string]string{}
-	if err := json.NewDecoder(res.Body).Decode(&resPayload); err != nil {
-		return "", err
+	if res.StatusCode != http.StatusOK {
+		tokenErr := TokenError{StatusCode: res.StatusCode}
+		json.NewDecoder(res.Body).Decode(&tokenErr)
+		return nil, tokenErr
+	}
+	resPayload := &AccessTokenResponse{}
+	if err := json.NewDecoder(res.Body).Decode(resPayload); err != nil {
+		return nil, err
+	}
+	if resPayload.AccessToken == "" {
+		return nil, TokenError{StatusCode: res.StatusCode, Code: "missing access_token"}
 	}
+	return resPayload, nil
+}
+
+// signState returns the cookie value holding state along with its signature
+func (g *Gopify) signState(state string) string {
+	hasher := hmac.New(sha256.New, []byte(g.ApiSecret))
+	hasher.Write([]byte(state))
+	return state + "." + base64.RawURLEncoding.EncodeToString(hasher.Sum(nil))
+}
+
+// verifyState checks the state returned by shopify against the signed state cookie
+func (g *Gopify) verifyState(r *http.Request, state string) bool {
+	cookie, err := r.Cookie(stateCookieName)
+	if err != nil || state == "" {
+		return false
+	}
+	return hmac.Equal([]byte(cookie.Value), []byte(g.signState(state)))
+}
 
-	return resPayload["access_token"], nil
+// BeginAuth returns an http handler that starts the oauth process for the shop in the shop query parameter.
+// It generates a random state, stores it in a signed cookie and redirects to shopify's consent page.
+func (g *Gopify) BeginAuth(opts ...AuthOption) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		shop := r.URL.Query().Get("shop")
+		if !ValidShop(shop) {
+			http.Error(w, ErrInvalidShop.Error(), http.StatusBadRequest)
+			return
+		}
+
+		state := uniqueToken(stateSize)
+		http.SetCookie(w, &http.Cookie{
+			Name:     stateCookieName,
+			Value:    g.signState(state),
+			Path:     "/",
+			MaxAge:   int(stateMaxAge.Seconds()),
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, g.AuthorizationUrl(shop, state, opts...), http.StatusFound)
+	})
+}
+
+// AuthCallback returns an http handler for the oauth redirect url.
+// It verifies the shop, the hmac and the state of the request, exchanges the code for an access token
+// and calls fn with the resulting session.
+func (g *Gopify) AuthCallback(fn func(w http.ResponseWriter, r *http.Request, s *Session)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		shop := q.Get("shop")
+		if !ValidShop(shop) {
+			http.Error(w, ErrInvalidShop.Error(), http.StatusBadRequest)
+			return
+		}
+
+		valid, err := g.validQueryHmac(r.URL.Query())
+		if err != nil {
+			http.Error(w, ErrUnauthorizedRequest.Error(), http.StatusBadRequest)
+			return
+		}
+		if !valid {
+			http.Error(w, ErrUnauthorizedRequest.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		if !g.verifyState(r, q.Get("state")) {
+			http.Error(w, ErrInvalidState.Error(), http.StatusForbidden)
+			return
+		}
+		// the state can only be used once
+		http.SetCookie(w, &http.Cookie{
+			Name:     stateCookieName,
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		token, err := g.AccessTokenCtx(r.Context(), shop, q.Get("code"))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		fn(w, r, NewSession(shop, token))
+	})
 }
@@ -1,6 +1,19 @@
 package gopify
 
-import "testing"
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
 
 func TestAuthorizationUrl(t *testing.T) {
 	gopify := Gopify{
@@ -11,15 +24,246 @@ func TestAuthorizationUrl(t *testing.T) {
 	}
 	cases := []struct {
 		shop        string
+		opts        []AuthOption
 		expectedUrl string
 	}{
-		{"osama.myshopify.com", "https://osama.myshopify.com/admin/oauth/authorize?client_id=key&redirect_uri=https%3A%2F%2Fexample.com%2Fauth&scope=read_products&state=state"},
+		{"osama.myshopify.com", nil, "https://osama.myshopify.com/admin/oauth/authorize?client_id=key&redirect_uri=https%3A%2F%2Fexample.com%2Fauth&scope=read_products&state=state"},
+		{"osama.myshopify.com", []AuthOption{WithOnlineAccess()}, "https://osama.myshopify.com/admin/oauth/authorize?client_id=key&grant_options%5B%5D=per-user&redirect_uri=https%3A%2F%2Fexample.com%2Fauth&scope=read_products&state=state"},
 	}
 
 	for _, c := range cases {
-		resultUrl := gopify.AuthorizationUrl(c.shop, "state")
+		resultUrl := gopify.AuthorizationUrl(c.shop, "state", c.opts...)
 		if resultUrl != c.expectedUrl {
 			t.Errorf("gopify.AuthorizationUrl():\n got %s; \n want %s", resultUrl, c.expectedUrl)
 		}
 	}
 }
+
+// shopTransport sends every request to the test server whatever the shop domain is
+type shopTransport struct {
+	server *httptest.Server
+}
+
+func (t shopTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	u, _ := url.Parse(t.server.URL)
+	r.URL.Scheme = u.Scheme
+	r.URL.Host = u.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// signQuery adds the hmac parameter shopify sends with its requests
+func signQuery(q url.Values, secret string) string {
+	message, _ := url.QueryUnescape(q.Encode())
+	hasher := hmac.New(sha256.New, []byte(secret))
+	hasher.Write([]byte(message))
+	q.Set("hmac", hex.EncodeToString(hasher.Sum(nil)))
+	return q.Encode()
+}
+
+func TestAuthFlow(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&params)
+		if r.URL.Path != "/admin/oauth/access_token" || params["code"] != "authcode" || params["client_secret"] != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "token", "scope": "read_products"}`)
+	}))
+	defer ts.Close()
+
+	gopify := Gopify{
+		ApiKey:      "key",
+		ApiSecret:   "secret",
+		RedirectUrl: "https://example.com/auth/callback",
+		Scopes:      []string{"read_products"},
+		HttpClient:  &http.Client{Transport: shopTransport{ts}},
+	}
+
+	// begin
+	req := httptest.NewRequest(http.MethodGet, "/auth?shop=osama.myshopify.com", nil)
+	rec := httptest.NewRecorder()
+	gopify.BeginAuth().ServeHTTP(rec, req)
+	res := rec.Result()
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("expected a redirect got %d", res.StatusCode)
+	}
+	location, _ := url.Parse(res.Header.Get("Location"))
+	state := location.Query().Get("state")
+	if location.Host != "osama.myshopify.com" || len(state) != stateSize {
+		t.Fatalf("unexpected authorization url %s", location)
+	}
+	cookies := res.Cookies()
+	if len(cookies) != 1 || cookies[0].Name != stateCookieName {
+		t.Fatalf("expected a state cookie got %v", cookies)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/auth?shop=evil.com", nil)
+	rec = httptest.NewRecorder()
+	gopify.BeginAuth().ServeHTTP(rec, req)
+	if rec.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("expected an invalid shop to be rejected got %d", rec.Result().StatusCode)
+	}
+
+	// callback
+	callbackQuery := func(shop, state string) string {
+		return signQuery(url.Values{
+			"code":      {"authcode"},
+			"shop":      {shop},
+			"state":     {state},
+			"timestamp": {"1337178173"},
+		}, gopify.ApiSecret)
+	}
+	cases := []struct {
+		query    string
+		cookie   *http.Cookie
+		expected int
+	}{
+		{callbackQuery("osama.myshopify.com", state), cookies[0], http.StatusOK},
+		{callbackQuery("osama.myshopify.com", "other state"), cookies[0], http.StatusForbidden},
+		{callbackQuery("osama.myshopify.com", state), nil, http.StatusForbidden},
+		{callbackQuery("osama.myshopify.com", state) + "&extra=1", cookies[0], http.StatusUnauthorized},
+		{callbackQuery("osama.example.com", state), cookies[0], http.StatusBadRequest},
+	}
+
+	for i, c := range cases {
+		var session *Session
+		h := gopify.AuthCallback(func(w http.ResponseWriter, r *http.Request, s *Session) {
+			session = s
+		})
+		req := httptest.NewRequest(http.MethodGet, "/auth/callback?"+c.query, nil)
+		if c.cookie != nil {
+			req.AddCookie(c.cookie)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Result().StatusCode != c.expected {
+			t.Errorf("case %d expected %d status code but got %d", i, c.expected, rec.Result().StatusCode)
+		}
+		if c.expected == http.StatusOK && (session == nil || session.AccessToken != "token" || session.Shop != "osama.myshopify.com") {
+			t.Errorf("case %d unexpected session %v", i, session)
+		}
+	}
+}
+
+func TestAccessToken(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&params)
+		switch params["code"] {
+		case "online":
+			fmt.Fprint(w, `{
+				"access_token": "token",
+				"scope": "write_orders,read_customers",
+				"expires_in": 86399,
+				"associated_user_scope": "write_orders",
+				"associated_user": {"id": 902541635, "first_name": "John", "email": "john@example.com", "email_verified": true, "account_owner": true}
+			}`)
+		case "offline":
+			fmt.Fprint(w, `{"access_token": "token", "scope": "write_orders,read_customers"}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "invalid_request", "error_description": "The authorization code was not found or was already used"}`)
+		}
+	}))
+	defer ts.Close()
+
+	gopify := Gopify{
+		ApiKey:     "key",
+		ApiSecret:  "secret",
+		HttpClient: &http.Client{Transport: shopTransport{ts}},
+	}
+
+	res, err := gopify.AccessToken("osama.myshopify.com", "online")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !res.Online() || res.AssociatedUser.ID != 902541635 || !res.AssociatedUser.AccountOwner || res.ExpiresIn != 86399 {
+		t.Errorf("unexpected online token response %+v", res)
+	}
+	if fmt.Sprint(res.Scopes()) != "[write_orders read_customers]" || res.AssociatedUserScope != "write_orders" {
+		t.Errorf("unexpected scopes %q %q", res.Scope, res.AssociatedUserScope)
+	}
+	s := NewSession("osama.myshopify.com", res)
+	if !s.Online() || s.Expires.IsZero() {
+		t.Errorf("expected an online session that expires got %+v", s)
+	}
+
+	res, err = gopify.AccessToken("osama.myshopify.com", "offline")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if res.Online() || NewSession("osama.myshopify.com", res).Expires != (time.Time{}) {
+		t.Errorf("expected an offline token that doesn't expire got %+v", res)
+	}
+
+	_, err = gopify.AccessToken("osama.myshopify.com", "used")
+	var tokenErr TokenError
+	if !errors.As(err, &tokenErr) || tokenErr.Code != "invalid_request" || tokenErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a token error got %v", err)
+	}
+
+	// the app secret must not be sent to a host that isn't a shop
+	_, err = gopify.AccessToken("attacker.example.com", "online")
+	if !errors.Is(err, ErrInvalidShop) {
+		t.Errorf("expected %v got %v", ErrInvalidShop, err)
+	}
+}
+
+func TestExchangeSessionToken(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&params)
+		if params["grant_type"] != tokenExchangeGrantType || params["subject_token_type"] != idTokenType || params["client_id"] != "key" {
+			t.Errorf("unexpected token exchange parameters %v", params)
+		}
+		if params["subject_token"] != "session token" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "invalid_subject_token"}`)
+			return
+		}
+		switch TokenType(params["requested_token_type"]) {
+		case OnlineAccessToken:
+			fmt.Fprint(w, `{"access_token": "online token", "scope": "read_products", "expires_in": 86399, "associated_user": {"id": 1}}`)
+		case OfflineAccessToken:
+			fmt.Fprint(w, `{"access_token": "offline token", "scope": "read_products"}`)
+		}
+	}))
+	defer ts.Close()
+
+	gopify := Gopify{
+		ApiKey:     "key",
+		ApiSecret:  "secret",
+		HttpClient: &http.Client{Transport: shopTransport{ts}},
+	}
+
+	cases := []struct {
+		shop      string
+		token     string
+		tokenType TokenType
+		expected  string
+		online    bool
+	}{
+		{"osama.myshopify.com", "session token", OnlineAccessToken, "online token", true},
+		{"osama.myshopify.com", "session token", OfflineAccessToken, "offline token", false},
+		{"osama.myshopify.com", "forged token", OfflineAccessToken, "", false},
+		{"example.com", "session token", OfflineAccessToken, "", false},
+	}
+
+	for i, c := range cases {
+		res, err := gopify.ExchangeSessionToken(context.Background(), c.shop, c.token, c.tokenType)
+		if c.expected == "" {
+			if err == nil {
+				t.Errorf("case %d expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("case %d unexpected error %v", i, err)
+		}
+		if res.AccessToken != c.expected || res.Online() != c.online {
+			t.Errorf("case %d unexpected response %+v", i, res)
+		}
+	}
+}
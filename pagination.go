@@ -1,12 +1,21 @@
 package gopify
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
+var (
+	// ErrStopPagination can be returned by pagination callbacks to stop without an error
+	ErrStopPagination = errors.New("stop pagination")
+)
+
 type Pagination struct {
 	Previous string
 	Next     string
@@ -39,3 +48,189 @@ func extractPagination(linkHeader string) (*Pagination, error) {
 	}
 	return pagination, nil
 }
+
+// PaginateOptions configures REST pagination with GetAll
+type PaginateOptions struct {
+	Limit    int // items per page, shopify's default is used when 0
+	MaxItems int // stop after this many items, all items are fetched when 0
+}
+
+// nextPageParams builds the query of the page with the given cursor,
+// shopify rejects any parameter other than limit and fields along with page_info
+func nextPageParams(params url.Values, cursor string) url.Values {
+	next := url.Values{
+		"page_info": {cursor},
+	}
+	for _, key := range []string{"limit", "fields"} {
+		if v, ok := params[key]; ok {
+			next[key] = v
+		}
+	}
+	return next
+}
+
+// GetAll performs get requests on path following the next page cursors until the last page,
+// and calls fn with every item of the array found under key in the response body, like "products".
+//
+// queryParams are only sent with the first page since shopify doesn't accept filters with page_info.
+// Returning ErrStopPagination from fn stops the pagination without an error.
+func (c *Client) GetAll(ctx context.Context, path string, queryParams url.Values, key string, opts PaginateOptions, fn func(item json.RawMessage) error) error {
+	params := url.Values{}
+	for k, v := range queryParams {
+		params[k] = v
+	}
+	if opts.Limit > 0 {
+		params.Set("limit", strconv.Itoa(opts.Limit))
+	}
+
+	count := 0
+	for {
+		body := map[string]json.RawMessage{}
+		r, err := c.GetCtx(ctx, path, params, &body)
+		if err != nil {
+			return err
+		}
+		raw, ok := body[key]
+		if !ok {
+			return fmt.Errorf("key %q not found in the response of %s", key, path)
+		}
+		var items []json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return err
+		}
+
+		for _, item := range items {
+			if opts.MaxItems > 0 && count >= opts.MaxItems {
+				return nil
+			}
+			if err := fn(item); err != nil {
+				if errors.Is(err, ErrStopPagination) {
+					return nil
+				}
+				return err
+			}
+			count++
+		}
+
+		if r.Pagination.Next == "" || (opts.MaxItems > 0 && count >= opts.MaxItems) {
+			return nil
+		}
+		params = nextPageParams(params, r.Pagination.Next)
+	}
+}
+
+// PageInfo is the pagination state of a graphql connection
+type PageInfo struct {
+	HasNextPage bool   `json:"hasNextPage"`
+	EndCursor   string `json:"endCursor"`
+}
+
+// GraphqlPage is a single page of a graphql connection
+type GraphqlPage struct {
+	Nodes    []json.RawMessage
+	PageInfo PageInfo
+	Data     json.RawMessage // the whole response data of the page
+}
+
+type graphqlConnection struct {
+	Edges []struct {
+		Node json.RawMessage `json:"node"`
+	} `json:"edges"`
+	Nodes    []json.RawMessage `json:"nodes"`
+	PageInfo *PageInfo         `json:"pageInfo"`
+}
+
+// extractConnection finds the connection at the dot separated path in data, like "shop.products"
+func extractConnection(data json.RawMessage, path string) (*graphqlConnection, error) {
+	current := data
+	for _, field := range strings.Split(path, ".") {
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal(current, &fields); err != nil {
+			return nil, fmt.Errorf("connection %q not found: %w", path, err)
+		}
+		v, ok := fields[field]
+		if !ok || string(v) == "null" {
+			return nil, fmt.Errorf("connection %q not found", path)
+		}
+		current = v
+	}
+	conn := &graphqlConnection{}
+	if err := json.Unmarshal(current, conn); err != nil {
+		return nil, err
+	}
+	if conn.PageInfo == nil {
+		return nil, fmt.Errorf("connection %q has no pageInfo", path)
+	}
+	return conn, nil
+}
+
+// GraphqlPages sends query for every page of the connection found at connectionPath and calls fn with each page.
+//
+// connectionPath is the dot separated path of the connection in the response data, like "products" or "shop.locations".
+// The query must take an $after: String variable passed as the after argument of the connection
+// and select pageInfo { hasNextPage endCursor } along with edges { node } or nodes.
+// Pages after the first one declare the cost of the previous page so they wait for the shop to afford it.
+// Returning ErrStopPagination from fn stops the pagination without an error.
+func (c *Client) GraphqlPages(ctx context.Context, query string, variables map[string]any, connectionPath string, fn func(page *GraphqlPage) error) error {
+	vars := make(map[string]any, len(variables)+1)
+	for k, v := range variables {
+		vars[k] = v
+	}
+	_, costDeclared := ctx.Value(queryCostCtxKey).(int)
+	pageCtx := ctx
+
+	for {
+		result, err := c.graphql(pageCtx, graphqlBody(query, vars))
+		if err != nil {
+			return err
+		}
+		if !result.hasData() {
+			return ErrNoGraphqlData
+		}
+		conn, err := extractConnection(result.Data, connectionPath)
+		if err != nil {
+			return err
+		}
+
+		page := &GraphqlPage{
+			Nodes:    conn.Nodes,
+			PageInfo: *conn.PageInfo,
+			Data:     result.Data,
+		}
+		if len(conn.Edges) > 0 {
+			page.Nodes = make([]json.RawMessage, len(conn.Edges))
+			for i, edge := range conn.Edges {
+				page.Nodes[i] = edge.Node
+			}
+		}
+		if err := fn(page); err != nil {
+			if errors.Is(err, ErrStopPagination) {
+				return nil
+			}
+			return err
+		}
+
+		if !page.PageInfo.HasNextPage {
+			return nil
+		}
+		if page.PageInfo.EndCursor == "" {
+			return fmt.Errorf("connection %q has a next page but no endCursor", connectionPath)
+		}
+		vars["after"] = page.PageInfo.EndCursor
+		if cost := result.Extensions.Cost; !costDeclared && cost != nil && cost.RequestedQueryCost > 0 {
+			pageCtx = WithQueryCost(ctx, int(cost.RequestedQueryCost))
+		}
+	}
+}
+
+// GraphqlNodes is like GraphqlPages but calls fn with every node of the connection
+func (c *Client) GraphqlNodes(ctx context.Context, query string, variables map[string]any, connectionPath string, fn func(node json.RawMessage) error) error {
+	return c.GraphqlPages(ctx, query, variables, connectionPath, func(page *GraphqlPage) error {
+		for _, node := range page.Nodes {
+			if err := fn(node); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
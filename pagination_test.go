@@ -1,7 +1,13 @@
 package gopify
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 )
 
@@ -35,3 +41,129 @@ func TestExtractPagination(t *testing.T) {
 		}
 	}
 }
+
+func TestGetAll(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("limit") != "2" {
+			t.Errorf("expected limit 2 got %q", q.Get("limit"))
+		}
+		switch q.Get("page_info") {
+		case "":
+			if q.Get("status") != "active" {
+				t.Errorf("expected the first page to keep the filters got %v", q)
+			}
+			w.Header().Set("Link", fmt.Sprintf(`<http://%s%s?limit=2&page_info=page2>; rel="next"`, r.Host, r.URL.Path))
+			fmt.Fprint(w, `{"products": [{"title": "Product 1"}, {"title": "Product 2"}]}`)
+		case "page2":
+			if q.Get("status") != "" {
+				t.Errorf("expected filters to be stripped with page_info got %v", q)
+			}
+			w.Header().Set("Link", fmt.Sprintf(`<http://%s%s?limit=2&page_info=page1>; rel="previous"`, r.Host, r.URL.Path))
+			fmt.Fprint(w, `{"products": [{"title": "Product 3"}]}`)
+		}
+	}))
+	defer ts.Close()
+
+	apiClient := NewClient(ts.URL[7:], "access token")
+	apiClient.baseUrl = fmt.Sprintf("%s/admin/api/%s", ts.URL, apiClient.version)
+	params := url.Values{"status": {"active"}}
+
+	cases := []struct {
+		opts     PaginateOptions
+		expected string
+	}{
+		{PaginateOptions{Limit: 2}, "[Product 1 Product 2 Product 3]"},
+		{PaginateOptions{Limit: 2, MaxItems: 1}, "[Product 1]"},
+		{PaginateOptions{Limit: 2, MaxItems: 3}, "[Product 1 Product 2 Product 3]"},
+	}
+
+	for i, c := range cases {
+		titles := []string{}
+		err := apiClient.GetAll(context.Background(), "products.json", params, "products", c.opts, func(item json.RawMessage) error {
+			product := struct {
+				Title string `json:"title"`
+			}{}
+			if err := json.Unmarshal(item, &product); err != nil {
+				return err
+			}
+			titles = append(titles, product.Title)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("case %d unexpected error %v", i, err)
+		}
+		if fmt.Sprint(titles) != c.expected {
+			t.Errorf("case %d expected items %s got %v", i, c.expected, titles)
+		}
+	}
+
+	// a wrapped ErrStopPagination stops the pagination without an error too
+	count := 0
+	err := apiClient.GetAll(context.Background(), "products.json", params, "products", PaginateOptions{Limit: 2}, func(item json.RawMessage) error {
+		count++
+		return fmt.Errorf("found it: %w", ErrStopPagination)
+	})
+	if err != nil || count != 1 {
+		t.Errorf("expected pagination to stop after 1 item got %d items and error %v", count, err)
+	}
+}
+
+func TestGraphqlPages(t *testing.T) {
+	pages := map[string]string{
+		"":        `{"data": {"shop": {"products": {"edges": [{"node": {"title": "Product 1"}}, {"node": {"title": "Product 2"}}], "pageInfo": {"hasNextPage": true, "endCursor": "cursor1"}}}}}`,
+		"cursor1": `{"data": {"shop": {"products": {"edges": [{"node": {"title": "Product 3"}}], "pageInfo": {"hasNextPage": false, "endCursor": "cursor2"}}}}}`,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := struct {
+			Variables map[string]any `json:"variables"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.Variables["first"] != 2.0 {
+			t.Errorf("expected caller variables to be kept got %v", body.Variables)
+		}
+		after, _ := body.Variables["after"].(string)
+		fmt.Fprint(w, pages[after])
+	}))
+	defer ts.Close()
+
+	apiClient := NewClient(ts.URL[7:], "access token")
+	apiClient.baseUrl = fmt.Sprintf("%s/admin/api/%s", ts.URL, apiClient.version)
+	query := `query ($first: Int!, $after: String) {
+		shop { products(first: $first, after: $after) { edges { node { title } } pageInfo { hasNextPage endCursor } } }
+	}`
+
+	titles := []string{}
+	err := apiClient.GraphqlNodes(context.Background(), query, map[string]any{"first": 2}, "shop.products", func(node json.RawMessage) error {
+		product := struct {
+			Title string `json:"title"`
+		}{}
+		if err := json.Unmarshal(node, &product); err != nil {
+			return err
+		}
+		titles = append(titles, product.Title)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if fmt.Sprint(titles) != "[Product 1 Product 2 Product 3]" {
+		t.Errorf("unexpected nodes %v", titles)
+	}
+
+	pageCount := 0
+	err = apiClient.GraphqlPages(context.Background(), query, map[string]any{"first": 2}, "shop.products", func(page *GraphqlPage) error {
+		pageCount++
+		return fmt.Errorf("enough pages: %w", ErrStopPagination)
+	})
+	if err != nil || pageCount != 1 {
+		t.Errorf("expected pagination to stop after 1 page got %d pages and error %v", pageCount, err)
+	}
+
+	err = apiClient.GraphqlPages(context.Background(), query, map[string]any{"first": 2}, "shop.orders", func(page *GraphqlPage) error {
+		return nil
+	})
+	if err == nil {
+		t.Errorf("expected an error for a missing connection")
+	}
+}
@@ -0,0 +1,337 @@
+package gopify
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRestBucketSize = 40
+	// shopify leaks a twentieth of the bucket every second,
+	// 2 requests/second for the standard 40 bucket and 4 for the plus 80 bucket
+	restLeakDivisor = 20
+
+	defaultGraphqlMaximumAvailable = 1000
+	defaultGraphqlRestoreRate      = 50
+	// cost reserved for queries that didn't declare one with WithQueryCost
+	defaultQueryCost = 50
+
+	// limiters that weren't used for this long and have recovered their whole bucket are dropped from their registry
+	limiterIdleTTL = 10 * time.Minute
+)
+
+var (
+	queryCostCtxKey = &contextKey{"QueryCost"}
+)
+
+// DefaultLimiterRegistry is the registry used by clients created without WithLimiterRegistry,
+// so clients for the same shop share their rate limits by default.
+var DefaultLimiterRegistry = NewLimiterRegistry()
+
+// RestLimiter is a leaky bucket that mirrors the shopify REST Admin API rate limit of a shop.
+// It is safe for concurrent use.
+type RestLimiter struct {
+	mu           sync.Mutex
+	size         float64
+	leakRate     float64 // requests per second
+	level        float64
+	updated      time.Time
+	used         time.Time
+	blockedUntil time.Time
+	now          func() time.Time
+}
+
+// NewRestLimiter creates a limiter with shopify's standard bucket,
+// the actual bucket size is learned from the responses.
+func NewRestLimiter() *RestLimiter {
+	return &RestLimiter{
+		size:     defaultRestBucketSize,
+		leakRate: defaultRestBucketSize / restLeakDivisor,
+		now:      time.Now,
+	}
+}
+
+// leak empties the bucket according to the time elapsed since the last update
+func (l *RestLimiter) leak(now time.Time) {
+	if !l.updated.IsZero() {
+		l.level -= now.Sub(l.updated).Seconds() * l.leakRate
+		if l.level < 0 {
+			l.level = 0
+		}
+	}
+	l.updated = now
+}
+
+// reserve takes a slot in the bucket and returns how long to wait before using it
+func (l *RestLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.leak(now)
+
+	var delay time.Duration
+	if l.blockedUntil.After(now) {
+		delay = l.blockedUntil.Sub(now)
+	}
+	if over := l.level + 1 - l.size; over > 0 {
+		if d := time.Duration(over / l.leakRate * float64(time.Second)); d > delay {
+			delay = d
+		}
+	}
+	l.level++
+	l.used = now
+	return delay
+}
+
+// idle reports whether the bucket is empty and wasn't used for ttl
+func (l *RestLimiter) idle(now time.Time, ttl time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.leak(now)
+	return l.level == 0 && !l.blockedUntil.After(now) && now.Sub(l.used) >= ttl
+}
+
+// Wait blocks until a request can be sent without exceeding the rate limit or ctx is done
+func (l *RestLimiter) Wait(ctx context.Context) error {
+	if err := sleep(ctx, l.reserve()); err != nil {
+		// give back the slot that will never be used
+		l.mu.Lock()
+		l.level--
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// update syncs the bucket with the X-Shopify-Shop-Api-Call-Limit header value
+func (l *RestLimiter) update(callLimit string) {
+	s := strings.Split(callLimit, "/")
+	if len(s) != 2 {
+		return
+	}
+	used, err := strconv.Atoi(s[0])
+	if err != nil {
+		return
+	}
+	size, err := strconv.Atoi(s[1])
+	if err != nil || size <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.leak(l.now())
+	l.size = float64(size)
+	l.leakRate = float64(size) / restLeakDivisor
+	// other processes may share the same bucket, so trust whichever view is fuller
+	if float64(used) > l.level {
+		l.level = float64(used)
+	}
+}
+
+// block fills the bucket and stops all requests for d, it is used when shopify responds with 429
+func (l *RestLimiter) block(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.leak(now)
+	l.level = l.size
+	if until := now.Add(d); until.After(l.blockedUntil) {
+		l.blockedUntil = until
+	}
+}
+
+// WithQueryCost returns a copy of ctx that declares the estimated cost of the graphql query sent with it,
+// so the client waits until the shop can afford it instead of being throttled.
+func WithQueryCost(ctx context.Context, cost int) context.Context {
+	return context.WithValue(ctx, queryCostCtxKey, cost)
+}
+
+func queryCostFromContext(ctx context.Context) int {
+	if cost, ok := ctx.Value(queryCostCtxKey).(int); ok && cost > 0 {
+		return cost
+	}
+	return defaultQueryCost
+}
+
+// throttleStatus is the cost throttle state returned in the graphql response extensions
+type throttleStatus struct {
+	MaximumAvailable   float64 `json:"maximumAvailable"`
+	CurrentlyAvailable float64 `json:"currentlyAvailable"`
+	RestoreRate        float64 `json:"restoreRate"`
+}
+
+// GraphqlLimiter mirrors the calculated query cost limit of a shop's graphql Admin API.
+// It is safe for concurrent use.
+type GraphqlLimiter struct {
+	mu          sync.Mutex
+	maximum     float64
+	available   float64 // points available as last reported by shopify and restored since
+	restoreRate float64 // points per second
+	pending     float64 // cost reserved by queries that are still in flight
+	updated     time.Time
+	used        time.Time
+	now         func() time.Time
+}
+
+// NewGraphqlLimiter creates a limiter with shopify's standard cost bucket,
+// the actual values are learned from the responses.
+func NewGraphqlLimiter() *GraphqlLimiter {
+	return &GraphqlLimiter{
+		maximum:     defaultGraphqlMaximumAvailable,
+		available:   defaultGraphqlMaximumAvailable,
+		restoreRate: defaultGraphqlRestoreRate,
+		now:         time.Now,
+	}
+}
+
+// restore refills the available points according to the time elapsed since the last update
+func (l *GraphqlLimiter) restore(now time.Time) {
+	if !l.updated.IsZero() {
+		l.available += now.Sub(l.updated).Seconds() * l.restoreRate
+		if l.available > l.maximum {
+			l.available = l.maximum
+		}
+	}
+	l.updated = now
+}
+
+// reserve takes cost points from the bucket and returns how long to wait until they are restored,
+// along with the points reserved which done must release
+func (l *GraphqlLimiter) reserve(cost int) (time.Duration, float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.restore(l.now())
+
+	c := float64(cost)
+	if c > l.maximum {
+		// the query can never be afforded, let shopify reject it
+		c = l.maximum
+	}
+	var delay time.Duration
+	if need := c + l.pending - l.available; need > 0 {
+		delay = time.Duration(need / l.restoreRate * float64(time.Second))
+	}
+	l.pending += c
+	l.used = l.updated
+	return delay, c
+}
+
+// idle reports whether no query is in flight, the bucket is full and it wasn't used for ttl
+func (l *GraphqlLimiter) idle(now time.Time, ttl time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.restore(now)
+	return l.pending <= 0 && l.available >= l.maximum && now.Sub(l.used) >= ttl
+}
+
+// wait blocks until a query of the given cost can be afforded or ctx is done.
+// Every successful wait must be followed by a call to done with the reserved points it returns.
+func (l *GraphqlLimiter) wait(ctx context.Context, cost int) (float64, error) {
+	delay, reserved := l.reserve(cost)
+	if err := sleep(ctx, delay); err != nil {
+		l.done(reserved, nil)
+		return 0, err
+	}
+	return reserved, nil
+}
+
+// done releases the points reserved by wait and syncs the bucket with the throttle status
+// shopify returned for the query, if any
+func (l *GraphqlLimiter) done(reserved float64, status *throttleStatus) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending -= reserved
+	if status == nil || status.MaximumAvailable <= 0 || status.RestoreRate <= 0 {
+		return
+	}
+	l.maximum = status.MaximumAvailable
+	l.restoreRate = status.RestoreRate
+	l.available = status.CurrentlyAvailable
+	l.updated = l.now()
+}
+
+// LimiterRegistry holds the rate limiters of each shop so they can be shared by many clients.
+// Limiters that weren't used for 10 minutes and have recovered their whole bucket are dropped,
+// so the registry doesn't grow with every shop ever seen. A client keeps the limiters it was created with,
+// so clients should be created per request or task rather than kept around for idle shops.
+// Remove drops the limiters of a shop right away, like when the app is uninstalled.
+// It is safe for concurrent use.
+type LimiterRegistry struct {
+	mu        sync.Mutex
+	rest      map[string]*RestLimiter
+	graphql   map[string]*GraphqlLimiter
+	idleTTL   time.Duration
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+// NewLimiterRegistry creates an empty limiter registry
+func NewLimiterRegistry() *LimiterRegistry {
+	return &LimiterRegistry{
+		rest:    make(map[string]*RestLimiter),
+		graphql: make(map[string]*GraphqlLimiter),
+		idleTTL: limiterIdleTTL,
+		now:     time.Now,
+	}
+}
+
+// prune drops the idle limiters, at most once per idle ttl. The caller must hold r.mu
+func (r *LimiterRegistry) prune() {
+	now := r.now()
+	if now.Sub(r.lastPrune) < r.idleTTL {
+		return
+	}
+	r.lastPrune = now
+	for shop, l := range r.rest {
+		if l.idle(now, r.idleTTL) {
+			delete(r.rest, shop)
+		}
+	}
+	for shop, l := range r.graphql {
+		if l.idle(now, r.idleTTL) {
+			delete(r.graphql, shop)
+		}
+	}
+}
+
+// Rest returns the REST limiter of the given shop domain, creating it if needed
+func (r *LimiterRegistry) Rest(shop string) *RestLimiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prune()
+	l, ok := r.rest[shop]
+	if !ok {
+		l = NewRestLimiter()
+		l.now = r.now
+		l.used = r.now()
+		r.rest[shop] = l
+	}
+	return l
+}
+
+// Graphql returns the graphql limiter of the given shop domain, creating it if needed
+func (r *LimiterRegistry) Graphql(shop string) *GraphqlLimiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prune()
+	l, ok := r.graphql[shop]
+	if !ok {
+		l = NewGraphqlLimiter()
+		l.now = r.now
+		l.used = r.now()
+		r.graphql[shop] = l
+	}
+	return l
+}
+
+// Remove drops the limiters of the given shop domain
+func (r *LimiterRegistry) Remove(shop string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.rest, shop)
+	delete(r.graphql, shop)
+}
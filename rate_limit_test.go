@@ -0,0 +1,198 @@
+package gopify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRestLimiterReserve(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewRestLimiter()
+	l.now = func() time.Time { return now }
+	l.update("38/40")
+
+	cases := []struct {
+		advance  time.Duration
+		expected time.Duration
+	}{
+		{0, 0},                                // 39/40
+		{0, 0},                                // 40/40
+		{0, 500 * time.Millisecond},           // 41/40, one request must leak at 2/s
+		{0, time.Second},                      // 42/40
+		{time.Second, 500 * time.Millisecond}, // leaked 2 requests, 41/40
+	}
+
+	for i, c := range cases {
+		now = now.Add(c.advance)
+		if d := l.reserve(); d != c.expected {
+			t.Errorf("case %d expected a delay of %v got %v", i, c.expected, d)
+		}
+	}
+}
+
+func TestRestLimiterLearnsBucketSize(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewRestLimiter()
+	l.now = func() time.Time { return now }
+	l.update("80/80")
+
+	if d := l.reserve(); d != 250*time.Millisecond {
+		t.Errorf("expected a delay of %v for a plus bucket got %v", 250*time.Millisecond, d)
+	}
+}
+
+func TestRestLimiterBlock(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewRestLimiter()
+	l.now = func() time.Time { return now }
+	l.block(3 * time.Second)
+
+	if d := l.reserve(); d != 3*time.Second {
+		t.Errorf("expected a delay of %v after a 429 got %v", 3*time.Second, d)
+	}
+}
+
+func TestLimiterRegistry(t *testing.T) {
+	r := NewLimiterRegistry()
+	limiters := make([]*RestLimiter, 10)
+	var wg sync.WaitGroup
+	for i := range limiters {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			limiters[i] = r.Rest("shop.myshopify.com")
+		}(i)
+	}
+	wg.Wait()
+
+	for i, l := range limiters {
+		if l != limiters[0] {
+			t.Errorf("limiter %d is not shared", i)
+		}
+	}
+	if r.Rest("other.myshopify.com") == limiters[0] {
+		t.Errorf("different shops share the same limiter")
+	}
+}
+
+func TestLimiterRegistryPrune(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := NewLimiterRegistry()
+	r.now = func() time.Time { return now }
+
+	busy := r.Rest("busy.myshopify.com")
+	idle := r.Rest("idle.myshopify.com")
+	graphql := r.Graphql("idle.myshopify.com")
+	graphql.wait(context.Background(), 10)
+	removed := r.Rest("removed.myshopify.com")
+	for i := 0; i < 30; i++ {
+		busy.reserve()
+	}
+	idle.reserve()
+
+	// the limiters of an uninstalled shop can be dropped right away
+	r.Remove("removed.myshopify.com")
+	if r.Rest("removed.myshopify.com") == removed {
+		t.Errorf("expected the removed limiter to be dropped")
+	}
+
+	// after the idle ttl, only the limiters that recovered their whole bucket are dropped
+	now = now.Add(limiterIdleTTL)
+	busy.reserve()
+	if r.Rest("busy.myshopify.com") != busy {
+		t.Errorf("expected the limiter in use to be kept")
+	}
+	if r.Rest("idle.myshopify.com") == idle {
+		t.Errorf("expected the idle rest limiter to be dropped")
+	}
+	// the graphql query is still in flight
+	if r.Graphql("idle.myshopify.com") != graphql {
+		t.Errorf("expected the graphql limiter with a query in flight to be kept")
+	}
+	graphql.done(10, nil)
+	now = now.Add(limiterIdleTTL)
+	if r.Graphql("idle.myshopify.com") == graphql {
+		t.Errorf("expected the idle graphql limiter to be dropped")
+	}
+}
+
+func TestGraphqlLimiterReserve(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewGraphqlLimiter()
+	l.now = func() time.Time { return now }
+	l.done(0, &throttleStatus{MaximumAvailable: 1000, CurrentlyAvailable: 100, RestoreRate: 50})
+
+	if d, _ := l.reserve(80); d != 0 {
+		t.Errorf("expected no delay for an affordable query got %v", d)
+	}
+	// 80 points are still in flight, so only 20 are left
+	if d, _ := l.reserve(120); d != 2*time.Second {
+		t.Errorf("expected a delay of %v got %v", 2*time.Second, d)
+	}
+	l.done(80, &throttleStatus{MaximumAvailable: 1000, CurrentlyAvailable: 90, RestoreRate: 50})
+	l.done(120, nil)
+
+	now = now.Add(time.Second)
+	if d, _ := l.reserve(200); d != time.Second+200*time.Millisecond {
+		t.Errorf("expected a delay of %v got %v", time.Second+200*time.Millisecond, d)
+	}
+}
+
+func TestGraphqlLimiterCappedCost(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewGraphqlLimiter()
+	l.now = func() time.Time { return now }
+	l.done(0, &throttleStatus{MaximumAvailable: 1000, CurrentlyAvailable: 1000, RestoreRate: 50})
+
+	// a query costing more than the bucket only reserves the whole bucket
+	d, reserved := l.reserve(5000)
+	if d != 0 || reserved != 1000 {
+		t.Errorf("expected to reserve 1000 points without delay got %v, %v", reserved, d)
+	}
+	if d, _ := l.reserve(10); d != 200*time.Millisecond {
+		t.Errorf("expected a delay of %v got %v", 200*time.Millisecond, d)
+	}
+	l.done(10, nil)
+
+	// releasing it frees the whole bucket
+	l.done(reserved, nil)
+	if d, _ := l.reserve(10); d != 0 {
+		t.Errorf("expected no delay once the query is done got %v", d)
+	}
+}
+
+func TestGraphqlThrottled(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			fmt.Fprint(w, `{"errors":[{"message":"Throttled","extensions":{"code":"THROTTLED"}}],
+				"extensions":{"cost":{"requestedQueryCost":10,"throttleStatus":{"maximumAvailable":1000,"currentlyAvailable":5,"restoreRate":50}}}}`)
+			return
+		}
+		fmt.Fprint(w, `{"data":{"shop":{"name":"test"}},
+			"extensions":{"cost":{"requestedQueryCost":10,"actualQueryCost":1,"throttleStatus":{"maximumAvailable":1000,"currentlyAvailable":4,"restoreRate":50}}}}`)
+	}))
+	defer ts.Close()
+
+	apiClient := NewClient(ts.URL[7:], "access token", WithLimiterRegistry(NewLimiterRegistry()))
+	apiClient.baseUrl = fmt.Sprintf("%s/admin/api/%s", ts.URL, apiClient.version)
+
+	start := time.Now()
+	data, err := apiClient.GraphqlCtx(WithQueryCost(context.Background(), 1), "{ shop { name } }", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if fmt.Sprint(data) != "map[shop:map[name:test]]" {
+		t.Errorf("unexpected data %v", data)
+	}
+	// 5 points were missing for the requested cost of 10, at 50 points per second
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected the client to wait about 100ms got %v", elapsed)
+	}
+}
@@ -0,0 +1,86 @@
+package gopify
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	ReauthorizeHeader    = "X-Shopify-API-Request-Failure-Reauthorize"
+	ReauthorizeUrlHeader = "X-Shopify-API-Request-Failure-Reauthorize-Url"
+)
+
+// expandScopes returns the set of scopes including the read scopes implied by write scopes,
+// like read_products for write_products
+func expandScopes(scopes []string) map[string]bool {
+	set := make(map[string]bool, len(scopes))
+	for _, scope := range scopes {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		set[scope] = true
+		if strings.HasPrefix(scope, "write_") {
+			set["read_"+strings.TrimPrefix(scope, "write_")] = true
+		} else if strings.HasPrefix(scope, "unauthenticated_write_") {
+			set["unauthenticated_read_"+strings.TrimPrefix(scope, "unauthenticated_write_")] = true
+		}
+	}
+	return set
+}
+
+// ScopesEqual reports whether two lists of scopes grant the same access, taking implied scopes into account,
+// so write_products,read_products equals write_products
+func ScopesEqual(a, b []string) bool {
+	setA, setB := expandScopes(a), expandScopes(b)
+	if len(setA) != len(setB) {
+		return false
+	}
+	for scope := range setA {
+		if !setB[scope] {
+			return false
+		}
+	}
+	return true
+}
+
+// RequireScopes returns a middleware that checks the scopes granted to the offline session of the shop
+// against g.Scopes, and asks for a new authorization when they differ or there is no session.
+//
+// The shop comes from the session token payload set by VerifyToken, or from the shop query parameter.
+// Requests from embedded apps get a 401 with the reauthorize headers App Bridge expects,
+// other requests are redirected to authPath, the path of the BeginAuth handler, with the shop query parameter.
+func (g *Gopify) RequireScopes(store SessionStore, authPath string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, embedded := PayloadFromContext(r.Context())
+		shop := r.URL.Query().Get("shop")
+		if embedded {
+			shop = payload.Shop()
+		}
+		if !ValidShop(shop) {
+			http.Error(w, ErrInvalidShop.Error(), http.StatusBadRequest)
+			return
+		}
+
+		session, err := store.Load(r.Context(), OfflineSessionID(shop))
+		if err != nil && !errors.Is(err, ErrSessionNotFound) {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if session != nil && ScopesEqual(session.Scopes, g.Scopes) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		authUrl := authPath + "?" + url.Values{"shop": {shop}}.Encode()
+		if embedded {
+			w.Header().Set(ReauthorizeHeader, "1")
+			w.Header().Set(ReauthorizeUrlHeader, authUrl)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, r, authUrl, http.StatusFound)
+	})
+}
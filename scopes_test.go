@@ -0,0 +1,80 @@
+package gopify
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestScopesEqual(t *testing.T) {
+	cases := []struct {
+		a, b     []string
+		expected bool
+	}{
+		{[]string{"read_products"}, []string{"read_products"}, true},
+		{[]string{"write_products"}, []string{"read_products", "write_products"}, true},
+		{[]string{"write_products"}, []string{"read_products"}, false},
+		{[]string{"read_products", "read_orders"}, []string{"read_products"}, false},
+		{[]string{"unauthenticated_write_checkouts"}, []string{"unauthenticated_read_checkouts", "unauthenticated_write_checkouts"}, true},
+	}
+
+	for i, c := range cases {
+		if ScopesEqual(c.a, c.b) != c.expected {
+			t.Errorf("case %d expected ScopesEqual(%v, %v) to be %v", i, c.a, c.b, c.expected)
+		}
+	}
+}
+
+func TestRequireScopes(t *testing.T) {
+	gopify := Gopify{
+		ApiKey:    "key",
+		ApiSecret: "hush",
+		Scopes:    []string{"write_products", "read_orders"},
+	}
+	store := NewMemorySessionStore()
+	store.Store(context.Background(), &Session{Shop: "current.myshopify.com", Scopes: []string{"read_products", "write_products", "read_orders"}})
+	store.Store(context.Background(), &Session{Shop: "outdated.myshopify.com", Scopes: []string{"write_products"}})
+
+	h := gopify.RequireScopes(store, "/auth", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	cases := []struct {
+		shop      string
+		embedded  bool
+		expected  int
+		reauthUrl string
+	}{
+		{"current.myshopify.com", false, http.StatusOK, ""},
+		{"current.myshopify.com", true, http.StatusOK, ""},
+		{"outdated.myshopify.com", false, http.StatusFound, "/auth?shop=outdated.myshopify.com"},
+		{"outdated.myshopify.com", true, http.StatusUnauthorized, "/auth?shop=outdated.myshopify.com"},
+		{"new.myshopify.com", false, http.StatusFound, "/auth?shop=new.myshopify.com"},
+		{"example.com", false, http.StatusBadRequest, ""},
+	}
+
+	for i, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/?shop="+c.shop, nil)
+		if c.embedded {
+			payload := &Payload{Dest: "https://" + c.shop}
+			req = httptest.NewRequest(http.MethodGet, "/", nil)
+			req = req.WithContext(context.WithValue(req.Context(), PayloadCtxKey, payload))
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		res := rec.Result()
+
+		if res.StatusCode != c.expected {
+			t.Errorf("case %d expected %d status code but got %d", i, c.expected, res.StatusCode)
+		}
+		switch res.StatusCode {
+		case http.StatusFound:
+			if res.Header.Get("Location") != c.reauthUrl {
+				t.Errorf("case %d expected a redirect to %s got %s", i, c.reauthUrl, res.Header.Get("Location"))
+			}
+		case http.StatusUnauthorized:
+			if res.Header.Get(ReauthorizeHeader) != "1" || res.Header.Get(ReauthorizeUrlHeader) != c.reauthUrl {
+				t.Errorf("case %d expected reauthorize headers got %v", i, res.Header)
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package gopify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSessionExpired = errors.New("session access token has expired")
+)
+
+var (
+	sessionCtxKey = &contextKey{"Session"}
+	clientCtxKey  = &contextKey{"Client"}
+)
+
+// Session holds the access token of a shop obtained through oauth
+type Session struct {
+	Shop        string   `json:"shop"`
+	AccessToken string   `json:"access_token"`
+	Scopes      []string `json:"scopes"`
+	// Expires is when the access token expires, it is zero for offline tokens that don't expire
+	Expires time.Time `json:"expires"`
+	// RefreshToken renews an expiring offline access token until RefreshTokenExpires
+	RefreshToken        string    `json:"refresh_token,omitempty"`
+	RefreshTokenExpires time.Time `json:"refresh_token_expires"`
+	// AssociatedUser is the user an online access token belongs to, it is nil for offline tokens
+	AssociatedUser       *AssociatedUser `json:"associated_user,omitempty"`
+	AssociatedUserScopes []string        `json:"associated_user_scopes,omitempty"`
+}
+
+// NewSession creates the session of shop from an access token response
+func NewSession(shop string, res *AccessTokenResponse) *Session {
+	s := &Session{
+		Shop:                 shop,
+		AccessToken:          res.AccessToken,
+		Scopes:               res.Scopes(),
+		AssociatedUser:       res.AssociatedUser,
+		AssociatedUserScopes: splitScopes(res.AssociatedUserScope),
+	}
+	now := time.Now()
+	if res.ExpiresIn > 0 {
+		s.Expires = now.Add(time.Duration(res.ExpiresIn) * time.Second)
+	}
+	s.RefreshToken = res.RefreshToken
+	if res.RefreshTokenExpiresIn > 0 {
+		s.RefreshTokenExpires = now.Add(time.Duration(res.RefreshTokenExpiresIn) * time.Second)
+	}
+	return s
+}
+
+// OfflineSessionID returns the id of the offline session of shop
+func OfflineSessionID(shop string) string {
+	return "offline_" + shop
+}
+
+// OnlineSessionID returns the id of the online session of a user of shop
+func OnlineSessionID(shop string, userID int64) string {
+	return fmt.Sprintf("%s_%d", shop, userID)
+}
+
+// ID returns the id the session is stored under,
+// there is one offline session per shop and one online session per shop user
+func (s *Session) ID() string {
+	if s.Online() {
+		return OnlineSessionID(s.Shop, s.AssociatedUser.ID)
+	}
+	return OfflineSessionID(s.Shop)
+}
+
+// Online reports whether the session holds an online access token
+func (s *Session) Online() bool {
+	return s.AssociatedUser != nil
+}
+
+// Expired reports whether the access token of the session has expired
+func (s *Session) Expired() bool {
+	return !s.Expires.IsZero() && time.Now().After(s.Expires)
+}
+
+// Client creates an Api client authenticated with the session access token
+func (s *Session) Client(opts ...Option) *Client {
+	return NewClient(s.Shop, s.AccessToken, opts...)
+}
+
+// SessionFromContext returns the session LoadSession stored in ctx
+func SessionFromContext(ctx context.Context) (*Session, bool) {
+	s, ok := ctx.Value(sessionCtxKey).(*Session)
+	return s, ok && s != nil
+}
+
+// ClientFromContext returns the Api client LoadSession stored in ctx
+func ClientFromContext(ctx context.Context) (*Client, bool) {
+	c, ok := ctx.Value(clientCtxKey).(*Client)
+	return c, ok && c != nil
+}
+
+// refreshSources keeps one RefreshTokenSource per session id,
+// so the concurrent requests of a shop share its refreshes instead of each refreshing the same token
+type refreshSources struct {
+	g       *Gopify
+	store   SessionStore
+	mu      sync.Mutex
+	sources map[string]*RefreshTokenSource
+}
+
+// get returns the token source of s, updated with s if it was refreshed elsewhere
+func (r *refreshSources) get(s *Session) *RefreshTokenSource {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ts, ok := r.sources[s.ID()]
+	if !ok {
+		ts = r.g.NewRefreshTokenSource(s, r.store.Store)
+		r.sources[s.ID()] = ts
+		return ts
+	}
+	ts.update(s)
+	return ts
+}
+
+// remove drops the token source of the session id, once the session is no longer stored
+func (r *refreshSources) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sources, id)
+}
+
+// LoadSession returns a middleware that loads the session of the shop and user of the session token payload
+// set by VerifyToken, and stores it along with an Api client for it in the request context.
+//
+// tokenType selects the online session of the user or the offline session of the shop.
+// Requests without a stored session, or with an expired one, get a 401 so the app can authorize again.
+// Offline sessions with a refresh token are refreshed before the request when they are about to expire,
+// and get a client that refreshes the access token and stores the new session. The middleware keeps one
+// RefreshTokenSource per session so concurrent requests of a shop refresh its token once.
+// A session whose refresh token is rejected by shopify gets a 401 as well.
+func (g *Gopify) LoadSession(store SessionStore, tokenType TokenType, next http.Handler, opts ...Option) http.Handler {
+	sources := &refreshSources{
+		g:       g,
+		store:   store,
+		sources: make(map[string]*RefreshTokenSource),
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, ok := PayloadFromContext(r.Context())
+		if !ok {
+			http.Error(w, ErrNoTokenFound.Error(), http.StatusUnauthorized)
+			return
+		}
+		shop := payload.Shop()
+		id := OfflineSessionID(shop)
+		if tokenType == OnlineAccessToken {
+			userID, err := payload.UserID()
+			if err != nil {
+				http.Error(w, ErrInvalidToken.Error(), http.StatusBadRequest)
+				return
+			}
+			id = OnlineSessionID(shop, userID)
+		}
+
+		session, err := store.Load(r.Context(), id)
+		if errors.Is(err, ErrSessionNotFound) {
+			sources.remove(id)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		clientOpts := opts
+		if session.RefreshToken != "" && !session.Online() {
+			source := sources.get(session)
+			if _, err := source.Token(r.Context()); err != nil {
+				var tokenErr TokenError
+				if errors.As(err, &tokenErr) {
+					http.Error(w, ErrSessionExpired.Error(), http.StatusUnauthorized)
+					return
+				}
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			session = source.Session()
+			clientOpts = append(opts[:len(opts):len(opts)], WithTokenSource(source))
+		} else if session.Expired() {
+			http.Error(w, ErrSessionExpired.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), sessionCtxKey, session)
+		ctx = context.WithValue(ctx, clientCtxKey, session.Client(clientOpts...))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,379 @@
+package gopify
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+)
+
+// SessionStore persists shop sessions, Load returns ErrSessionNotFound for unknown ids
+type SessionStore interface {
+	Store(ctx context.Context, s *Session) error
+	Load(ctx context.Context, id string) (*Session, error)
+	Delete(ctx context.Context, id string) error
+	FindByShop(ctx context.Context, shop string) ([]*Session, error)
+}
+
+// copySession returns a copy of s so stored sessions can't be changed by callers
+func copySession(s *Session) *Session {
+	c := *s
+	c.Scopes = append([]string(nil), s.Scopes...)
+	c.AssociatedUserScopes = append([]string(nil), s.AssociatedUserScopes...)
+	if s.AssociatedUser != nil {
+		user := *s.AssociatedUser
+		c.AssociatedUser = &user
+	}
+	return &c
+}
+
+// MemorySessionStore keeps sessions in memory, it is safe for concurrent use
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+}
+
+// NewMemorySessionStore creates an empty in memory session store
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]*Session),
+	}
+}
+
+func (m *MemorySessionStore) Store(ctx context.Context, s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[s.ID()] = copySession(s)
+	return nil
+}
+
+func (m *MemorySessionStore) Load(ctx context.Context, id string) (*Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return copySession(s), nil
+}
+
+func (m *MemorySessionStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *MemorySessionStore) FindByShop(ctx context.Context, shop string) ([]*Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	sessions := []*Session{}
+	for _, s := range m.sessions {
+		if s.Shop == shop {
+			sessions = append(sessions, copySession(s))
+		}
+	}
+	return sessions, nil
+}
+
+// FileSessionStore keeps sessions in a JSON file, it is safe for concurrent use within a process
+type FileSessionStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileSessionStore creates a session store that reads and writes the JSON file at path,
+// the file is created on the first Store
+func NewFileSessionStore(path string) *FileSessionStore {
+	return &FileSessionStore{path: path}
+}
+
+func (f *FileSessionStore) read() (map[string]*Session, error) {
+	sessions := make(map[string]*Session)
+	b, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return sessions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// write replaces the file atomically so a crash never leaves it half written
+func (f *FileSessionStore) write(sessions map[string]*Session) error {
+	b, err := json.MarshalIndent(sessions, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+func (f *FileSessionStore) Store(ctx context.Context, s *Session) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sessions, err := f.read()
+	if err != nil {
+		return err
+	}
+	sessions[s.ID()] = s
+	return f.write(sessions)
+}
+
+func (f *FileSessionStore) Load(ctx context.Context, id string) (*Session, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sessions, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	s, ok := sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return s, nil
+}
+
+func (f *FileSessionStore) Delete(ctx context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sessions, err := f.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := sessions[id]; !ok {
+		return nil
+	}
+	delete(sessions, id)
+	return f.write(sessions)
+}
+
+func (f *FileSessionStore) FindByShop(ctx context.Context, shop string) ([]*Session, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sessions, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	found := []*Session{}
+	for _, s := range sessions {
+		if s.Shop == shop {
+			found = append(found, s)
+		}
+	}
+	return found, nil
+}
+
+// SQLOption configures the SQL backed stores
+type SQLOption func(c *sqlConfig)
+
+type sqlConfig struct {
+	table        string
+	placeholders func(n int) string
+}
+
+// WithTable sets the name of the table used by the store
+func WithTable(name string) SQLOption {
+	return func(c *sqlConfig) {
+		c.table = name
+	}
+}
+
+// WithDollarPlaceholders makes the store use $1, $2... query placeholders like postgres expects, instead of ?
+func WithDollarPlaceholders() SQLOption {
+	return func(c *sqlConfig) {
+		c.placeholders = func(n int) string {
+			return fmt.Sprintf("$%d", n)
+		}
+	}
+}
+
+func newSQLConfig(table string, opts []SQLOption) sqlConfig {
+	c := sqlConfig{
+		table: table,
+		placeholders: func(n int) string {
+			return "?"
+		},
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// query replaces every ? in q with the configured placeholders
+func (c sqlConfig) query(q string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			b.WriteString(c.placeholders(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// SQLSessionStore keeps sessions in a database/sql table
+type SQLSessionStore struct {
+	db     *sql.DB
+	config sqlConfig
+}
+
+// NewSQLSessionStore creates a session store using db, the table is named gopify_sessions unless WithTable is used.
+// Call CreateTable to create the table if it doesn't exist.
+func NewSQLSessionStore(db *sql.DB, opts ...SQLOption) *SQLSessionStore {
+	return &SQLSessionStore{
+		db:     db,
+		config: newSQLConfig("gopify_sessions", opts),
+	}
+}
+
+// CreateTable creates the sessions table if it doesn't exist
+func (s *SQLSessionStore) CreateTable(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+s.config.table+` (
+		id VARCHAR(255) PRIMARY KEY,
+		shop VARCHAR(255) NOT NULL,
+		access_token TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		expires BIGINT NOT NULL,
+		refresh_token TEXT NOT NULL,
+		refresh_token_expires BIGINT NOT NULL,
+		associated_user TEXT NOT NULL,
+		associated_user_scopes TEXT NOT NULL
+	)`)
+	return err
+}
+
+const sessionColumns = `shop, access_token, scopes, expires, refresh_token, refresh_token_expires, associated_user, associated_user_scopes`
+
+// unixTime converts t to unix seconds, with 0 for the zero time
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// fromUnixTime is the inverse of unixTime
+func fromUnixTime(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+func (s *SQLSessionStore) Store(ctx context.Context, session *Session) error {
+	user := ""
+	if session.AssociatedUser != nil {
+		b, err := json.Marshal(session.AssociatedUser)
+		if err != nil {
+			return err
+		}
+		user = string(b)
+	}
+
+	// delete and insert in a transaction since upserts aren't portable across databases
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, s.config.query(`DELETE FROM `+s.config.table+` WHERE id = ?`), session.ID()); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		s.config.query(`INSERT INTO `+s.config.table+` (id, `+sessionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		session.ID(), session.Shop, session.AccessToken, strings.Join(session.Scopes, ","), unixTime(session.Expires),
+		session.RefreshToken, unixTime(session.RefreshTokenExpires), user, strings.Join(session.AssociatedUserScopes, ","),
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanSession(row rowScanner) (*Session, error) {
+	var (
+		session                  Session
+		scopes, user, userScopes string
+		expires, refreshExpires  int64
+	)
+	err := row.Scan(&session.Shop, &session.AccessToken, &scopes, &expires, &session.RefreshToken, &refreshExpires, &user, &userScopes)
+	if err != nil {
+		return nil, err
+	}
+	session.Scopes = splitScopes(scopes)
+	session.AssociatedUserScopes = splitScopes(userScopes)
+	session.Expires = fromUnixTime(expires)
+	session.RefreshTokenExpires = fromUnixTime(refreshExpires)
+	if user != "" {
+		session.AssociatedUser = &AssociatedUser{}
+		if err := json.Unmarshal([]byte(user), session.AssociatedUser); err != nil {
+			return nil, err
+		}
+	}
+	return &session, nil
+}
+
+func (s *SQLSessionStore) Load(ctx context.Context, id string) (*Session, error) {
+	row := s.db.QueryRowContext(ctx, s.config.query(`SELECT `+sessionColumns+` FROM `+s.config.table+` WHERE id = ?`), id)
+	session, err := scanSession(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSessionNotFound
+	}
+	return session, err
+}
+
+func (s *SQLSessionStore) Delete(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, s.config.query(`DELETE FROM `+s.config.table+` WHERE id = ?`), id)
+	return err
+}
+
+func (s *SQLSessionStore) FindByShop(ctx context.Context, shop string) ([]*Session, error) {
+	rows, err := s.db.QueryContext(ctx, s.config.query(`SELECT `+sessionColumns+` FROM `+s.config.table+` WHERE shop = ?`), shop)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []*Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
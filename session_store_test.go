@@ -0,0 +1,361 @@
+package gopify
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testSessionStore(t *testing.T, store SessionStore) {
+	ctx := context.Background()
+	offline := &Session{
+		Shop:        "osama.myshopify.com",
+		AccessToken: "offline token",
+		Scopes:      []string{"read_products", "write_orders"},
+	}
+	online := &Session{
+		Shop:                 "osama.myshopify.com",
+		AccessToken:          "online token",
+		Scopes:               []string{"read_products"},
+		Expires:              time.Unix(1700000000, 0),
+		AssociatedUser:       &AssociatedUser{ID: 42, Email: "john@example.com"},
+		AssociatedUserScopes: []string{"read_products"},
+	}
+	other := &Session{Shop: "other.myshopify.com", AccessToken: "other token"}
+
+	for _, s := range []*Session{offline, online, other} {
+		if err := store.Store(ctx, s); err != nil {
+			t.Fatalf("unexpected error storing %s: %v", s.ID(), err)
+		}
+	}
+
+	s, err := store.Load(ctx, OfflineSessionID("osama.myshopify.com"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if s.AccessToken != "offline token" || len(s.Scopes) != 2 || s.Online() {
+		t.Errorf("unexpected offline session %+v", s)
+	}
+
+	s, err = store.Load(ctx, OnlineSessionID("osama.myshopify.com", 42))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !s.Online() || s.AssociatedUser.Email != "john@example.com" || !s.Expires.Equal(online.Expires) {
+		t.Errorf("unexpected online session %+v", s)
+	}
+
+	sessions, err := store.FindByShop(ctx, "osama.myshopify.com")
+	if err != nil || len(sessions) != 2 {
+		t.Errorf("expected 2 sessions for the shop got %d, %v", len(sessions), err)
+	}
+
+	offline.AccessToken = "new token"
+	if err := store.Store(ctx, offline); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if s, _ := store.Load(ctx, offline.ID()); s.AccessToken != "new token" {
+		t.Errorf("expected the session to be replaced got %+v", s)
+	}
+
+	if err := store.Delete(ctx, offline.ID()); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := store.Load(ctx, offline.ID()); err != ErrSessionNotFound {
+		t.Errorf("expected error %v got %v", ErrSessionNotFound, err)
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	testSessionStore(t, NewMemorySessionStore())
+}
+
+func TestFileSessionStore(t *testing.T) {
+	testSessionStore(t, NewFileSessionStore(filepath.Join(t.TempDir(), "sessions.json")))
+}
+
+func TestSQLSessionStore(t *testing.T) {
+	for _, opts := range [][]SQLOption{nil, {WithTable("sessions"), WithDollarPlaceholders()}} {
+		store := NewSQLSessionStore(openFakeDB(t), opts...)
+		if err := store.CreateTable(context.Background()); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		testSessionStore(t, store)
+	}
+}
+
+func TestSQLPlaceholders(t *testing.T) {
+	q := "DELETE FROM t WHERE id = ? AND shop = ?"
+	if got := newSQLConfig("t", nil).query(q); got != q {
+		t.Errorf("expected %q got %q", q, got)
+	}
+	expected := "DELETE FROM t WHERE id = $1 AND shop = $2"
+	if got := newSQLConfig("t", []SQLOption{WithDollarPlaceholders()}).query(q); got != expected {
+		t.Errorf("expected %q got %q", expected, got)
+	}
+}
+
+// fakeDriver is a tiny in memory database/sql driver understanding the queries of the SQL stores
+type fakeDriver struct {
+	mu  sync.Mutex
+	dbs map[string]*fakeDB
+}
+
+type fakeDB struct {
+	mu     sync.Mutex
+	tables map[string]*fakeTable
+}
+
+type fakeTable struct {
+	columns []string
+	rows    []map[string]driver.Value
+}
+
+var sqlFake = &fakeDriver{dbs: make(map[string]*fakeDB)}
+
+func init() {
+	sql.Register("gopifyfake", sqlFake)
+}
+
+// openFakeDB opens an empty database named after the test
+func openFakeDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("gopifyfake", t.Name())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		sqlFake.mu.Lock()
+		delete(sqlFake.dbs, t.Name())
+		sqlFake.mu.Unlock()
+	})
+	return db
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	db, ok := d.dbs[name]
+	if !ok {
+		db = &fakeDB{tables: make(map[string]*fakeTable)}
+		d.dbs[name] = db
+	}
+	return &fakeConn{db: db}, nil
+}
+
+type fakeConn struct {
+	db       *fakeDB
+	snapshot map[string]*fakeTable
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: strings.Join(strings.Fields(query), " ")}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.snapshot = make(map[string]*fakeTable, len(c.db.tables))
+	for name, table := range c.db.tables {
+		c.snapshot[name] = &fakeTable{columns: table.columns, rows: append([]map[string]driver.Value(nil), table.rows...)}
+	}
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.snapshot = nil
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.tables = c.snapshot
+	c.snapshot = nil
+	return nil
+}
+
+var (
+	createRegex = regexp.MustCompile(`^CREATE TABLE IF NOT EXISTS (\w+) \((.*)\)$`)
+	insertRegex = regexp.MustCompile(`^INSERT INTO (\w+) \(([^)]*)\) VALUES \(([^)]*)\)$`)
+	deleteRegex = regexp.MustCompile(`^DELETE FROM (\w+)(?: WHERE (.*))?$`)
+	selectRegex = regexp.MustCompile(`^SELECT (.*) FROM (\w+) WHERE (.*)$`)
+	condRegex   = regexp.MustCompile(`^(\w+) (=|<=) (?:\?|\$\d+)$`)
+)
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+// match returns the rows of table matching the where clause, args are consumed in order
+func (s *fakeStmt) match(table *fakeTable, where string, args []driver.Value) ([]int, error) {
+	conds := []string{}
+	if where != "" {
+		conds = strings.Split(where, " AND ")
+	}
+	if len(conds) != len(args) {
+		return nil, fmt.Errorf("expected %d arguments got %d", len(conds), len(args))
+	}
+	matched := []int{}
+	for i, row := range table.rows {
+		ok := true
+		for j, cond := range conds {
+			m := condRegex.FindStringSubmatch(cond)
+			if m == nil {
+				return nil, fmt.Errorf("unsupported condition %q", cond)
+			}
+			switch m[2] {
+			case "=":
+				ok = ok && row[m[1]] == args[j]
+			case "<=":
+				ok = ok && row[m[1]].(int64) <= args[j].(int64)
+			}
+		}
+		if ok {
+			matched = append(matched, i)
+		}
+	}
+	return matched, nil
+}
+
+func (s *fakeStmt) table(name string) (*fakeTable, error) {
+	table, ok := s.conn.db.tables[name]
+	if !ok {
+		return nil, fmt.Errorf("no such table %s", name)
+	}
+	return table, nil
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.conn.db.mu.Lock()
+	defer s.conn.db.mu.Unlock()
+
+	if m := createRegex.FindStringSubmatch(s.query); m != nil {
+		if _, ok := s.conn.db.tables[m[1]]; !ok {
+			table := &fakeTable{}
+			for _, def := range strings.Split(m[2], ",") {
+				table.columns = append(table.columns, strings.Fields(def)[0])
+			}
+			s.conn.db.tables[m[1]] = table
+		}
+		return driver.RowsAffected(0), nil
+	}
+	if m := insertRegex.FindStringSubmatch(s.query); m != nil {
+		table, err := s.table(m[1])
+		if err != nil {
+			return nil, err
+		}
+		columns := strings.Split(m[2], ", ")
+		if len(columns) != len(args) {
+			return nil, fmt.Errorf("expected %d arguments got %d", len(columns), len(args))
+		}
+		row := make(map[string]driver.Value, len(columns))
+		for i, column := range columns {
+			row[column] = args[i]
+		}
+		// the first column is the primary key
+		for _, r := range table.rows {
+			if r[table.columns[0]] == row[table.columns[0]] {
+				return nil, errors.New("UNIQUE constraint failed")
+			}
+		}
+		table.rows = append(table.rows, row)
+		return driver.RowsAffected(1), nil
+	}
+	if m := deleteRegex.FindStringSubmatch(s.query); m != nil {
+		table, err := s.table(m[1])
+		if err != nil {
+			return nil, err
+		}
+		matched, err := s.match(table, m[2], args)
+		if err != nil {
+			return nil, err
+		}
+		rows := table.rows[:0:0]
+		for i, row := range table.rows {
+			if len(matched) == 0 || matched[0] != i {
+				rows = append(rows, row)
+				continue
+			}
+			matched = matched[1:]
+		}
+		affected := len(table.rows) - len(rows)
+		table.rows = rows
+		return driver.RowsAffected(affected), nil
+	}
+	return nil, fmt.Errorf("unsupported query %q", s.query)
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.conn.db.mu.Lock()
+	defer s.conn.db.mu.Unlock()
+
+	m := selectRegex.FindStringSubmatch(s.query)
+	if m == nil {
+		return nil, fmt.Errorf("unsupported query %q", s.query)
+	}
+	table, err := s.table(m[2])
+	if err != nil {
+		return nil, err
+	}
+	matched, err := s.match(table, m[3], args)
+	if err != nil {
+		return nil, err
+	}
+	if m[1] == "COUNT(*)" {
+		return &fakeRows{columns: []string{"count"}, values: [][]driver.Value{{int64(len(matched))}}}, nil
+	}
+	rows := &fakeRows{columns: strings.Split(m[1], ", ")}
+	for _, i := range matched {
+		values := make([]driver.Value, len(rows.columns))
+		for j, column := range rows.columns {
+			values[j] = table.rows[i][column]
+		}
+		rows.values = append(rows.values, values)
+	}
+	return rows, nil
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
@@ -0,0 +1,149 @@
+package gopify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoadSession(t *testing.T) {
+	gopify := Gopify{ApiKey: "key", ApiSecret: "hush"}
+	store := NewMemorySessionStore()
+	store.Store(context.Background(), &Session{Shop: "osama.myshopify.com", AccessToken: "offline token"})
+	store.Store(context.Background(), &Session{
+		Shop:           "osama.myshopify.com",
+		AccessToken:    "online token",
+		Expires:        time.Now().Add(time.Hour),
+		AssociatedUser: &AssociatedUser{ID: 42},
+	})
+	store.Store(context.Background(), &Session{
+		Shop:           "osama.myshopify.com",
+		AccessToken:    "expired token",
+		Expires:        time.Now().Add(-time.Hour),
+		AssociatedUser: &AssociatedUser{ID: 7},
+	})
+
+	var token string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, _ := SessionFromContext(r.Context())
+		client, ok := ClientFromContext(r.Context())
+		if !ok || client.domain != "osama.myshopify.com" {
+			t.Errorf("expected a client for the shop got %+v", client)
+		}
+		token = session.AccessToken
+	})
+	offline := gopify.LoadSession(store, OfflineAccessToken, h)
+	online := gopify.LoadSession(store, OnlineAccessToken, h)
+
+	cases := []struct {
+		handler  http.Handler
+		payload  *Payload
+		expected int
+		token    string
+	}{
+		{offline, &Payload{Dest: "https://osama.myshopify.com", Sub: "42"}, http.StatusOK, "offline token"},
+		{online, &Payload{Dest: "https://osama.myshopify.com", Sub: "42"}, http.StatusOK, "online token"},
+		{online, &Payload{Dest: "https://osama.myshopify.com", Sub: "7"}, http.StatusUnauthorized, ""},
+		{online, &Payload{Dest: "https://osama.myshopify.com", Sub: "1"}, http.StatusUnauthorized, ""},
+		{online, &Payload{Dest: "https://osama.myshopify.com", Sub: "not a number"}, http.StatusBadRequest, ""},
+		{offline, &Payload{Dest: "https://other.myshopify.com"}, http.StatusUnauthorized, ""},
+		{offline, nil, http.StatusUnauthorized, ""},
+	}
+
+	for i, c := range cases {
+		token = ""
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if c.payload != nil {
+			req = req.WithContext(context.WithValue(req.Context(), PayloadCtxKey, c.payload))
+		}
+		rec := httptest.NewRecorder()
+		c.handler.ServeHTTP(rec, req)
+
+		if rec.Code != c.expected {
+			t.Errorf("case %d expected %d status code but got %d", i, c.expected, rec.Code)
+		}
+		if token != c.token {
+			t.Errorf("case %d expected the session with token %q got %q", i, c.token, token)
+		}
+	}
+}
+
+func TestLoadSessionRefresh(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		refreshes int
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&params)
+		mu.Lock()
+		defer mu.Unlock()
+		// refresh tokens are rotated, so a used one is rejected
+		if params["refresh_token"] != fmt.Sprintf("refresh%d", refreshes) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "invalid_grant"}`)
+			return
+		}
+		refreshes++
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprintf(w, `{"access_token": "token%d", "expires_in": 3600, "refresh_token": "refresh%d"}`, refreshes, refreshes)
+	}))
+	defer ts.Close()
+
+	gopify := Gopify{ApiKey: "key", ApiSecret: "hush", HttpClient: &http.Client{Transport: shopTransport{ts}}}
+	store := NewMemorySessionStore()
+	store.Store(context.Background(), &Session{
+		Shop:         "osama.myshopify.com",
+		AccessToken:  "token0",
+		Expires:      time.Now().Add(30 * time.Second),
+		RefreshToken: "refresh0",
+	})
+	h := gopify.LoadSession(store, OfflineAccessToken, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, _ := SessionFromContext(r.Context())
+		fmt.Fprint(w, session.AccessToken)
+	}))
+
+	// concurrent requests of the shop share a single refresh
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req = req.WithContext(context.WithValue(req.Context(), PayloadCtxKey, &Payload{Dest: "https://osama.myshopify.com"}))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK || rec.Body.String() != "token1" {
+				t.Errorf("expected the refreshed session in the context got %d %q", rec.Code, rec.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+	if refreshes != 1 {
+		t.Errorf("expected a single refresh got %d", refreshes)
+	}
+	stored, _ := store.Load(context.Background(), OfflineSessionID("osama.myshopify.com"))
+	if stored.AccessToken != "token1" || stored.RefreshToken != "refresh1" {
+		t.Errorf("expected the refreshed session to be stored got %+v", stored)
+	}
+
+	// a session whose refresh token is rejected needs to be authorized again
+	store.Store(context.Background(), &Session{
+		Shop:         "other.myshopify.com",
+		AccessToken:  "token0",
+		Expires:      time.Now().Add(-time.Hour),
+		RefreshToken: "revoked",
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), PayloadCtxKey, &Payload{Dest: "https://other.myshopify.com"}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d status code but got %d", http.StatusUnauthorized, rec.Code)
+	}
+}
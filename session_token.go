@@ -2,16 +2,19 @@ package gopify
 
 import (
 	"bytes"
+	"container/list"
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
-	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,8 +23,108 @@ var (
 	ErrTokenExpired     = errors.New("session token has expired")
 	ErrSignatureInvalid = errors.New("session token signature is invalid")
 	ErrNoTokenFound     = errors.New("no token found")
+	ErrUnsupportedAlg   = errors.New("session token algorithm is not HS256")
+	ErrTokenReplayed    = errors.New("session token was already used")
+	ErrMalformedToken   = errors.New("session token is malformed")
 )
 
+// MalformedTokenError describes why a session token couldn't be parsed,
+// errors.Is(err, ErrMalformedToken) is true for it
+type MalformedTokenError struct {
+	// Part is the part of the token that is malformed: token, header, payload or signature
+	Part string
+	Err  error
+}
+
+func (err *MalformedTokenError) Error() string {
+	return fmt.Sprintf("%v: invalid %s: %v", ErrMalformedToken, err.Part, err.Err)
+}
+
+func (err *MalformedTokenError) Unwrap() error {
+	return err.Err
+}
+
+func (err *MalformedTokenError) Is(target error) bool {
+	return target == ErrMalformedToken
+}
+
+// ReplayCache remembers the ids of the session tokens that were already used
+type ReplayCache interface {
+	// Seen records jti until exp and reports whether it was already recorded
+	Seen(jti string, exp time.Time) bool
+}
+
+type replayEntry struct {
+	jti     string
+	expires time.Time
+}
+
+// MemoryReplayCache is an in memory ReplayCache, it is safe for concurrent use
+type MemoryReplayCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// order holds the entries from the oldest recorded to the newest,
+	// session tokens share the same lifetime so it is close to their expiry order
+	order *list.List
+	now   func() time.Time
+}
+
+// NewMemoryReplayCache creates an empty in memory replay cache
+func NewMemoryReplayCache() *MemoryReplayCache {
+	return &MemoryReplayCache{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+func (m *MemoryReplayCache) Seen(jti string, exp time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	// drop the oldest entries as long as they have expired
+	for el := m.order.Front(); el != nil && now.After(el.Value.(*replayEntry).expires); el = m.order.Front() {
+		m.remove(el)
+	}
+	if el, ok := m.entries[jti]; ok {
+		if !now.After(el.Value.(*replayEntry).expires) {
+			return true
+		}
+		m.remove(el)
+	}
+	m.entries[jti] = m.order.PushBack(&replayEntry{jti: jti, expires: exp})
+	return false
+}
+
+func (m *MemoryReplayCache) remove(el *list.Element) {
+	m.order.Remove(el)
+	delete(m.entries, el.Value.(*replayEntry).jti)
+}
+
+// TokenVerifier configures how session tokens are verified
+type TokenVerifier struct {
+	// Leeway is the clock skew tolerated when checking the exp, nbf and iat claims
+	Leeway time.Duration
+	// Now returns the current time, time.Now is used when nil
+	Now func() time.Time
+	// ReplayCache rejects tokens whose jti was already seen when set
+	ReplayCache ReplayCache
+}
+
+func (v *TokenVerifier) now() time.Time {
+	if v.Now != nil {
+		return v.Now()
+	}
+	return time.Now()
+}
+
+func (g *Gopify) tokenVerifier() *TokenVerifier {
+	if g.TokenVerifier != nil {
+		return g.TokenVerifier
+	}
+	return &TokenVerifier{}
+}
+
 var (
 	PayloadCtxKey = &contextKey{"TokenPayload"}
 )
@@ -48,16 +151,43 @@ type Payload struct {
 	Sid  string `json:"sid"`
 }
 
+// PayloadFromContext returns the session token payload VerifyToken stored in ctx
+func PayloadFromContext(ctx context.Context) (*Payload, bool) {
+	p, ok := ctx.Value(PayloadCtxKey).(*Payload)
+	return p, ok && p != nil
+}
+
+// Shop returns the shop domain the token was issued for, taken from the dest claim
+func (p *Payload) Shop() string {
+	dest, err := url.Parse(p.Dest)
+	if err != nil {
+		return ""
+	}
+	return dest.Hostname()
+}
+
+// UserID returns the id of the shop user the token was issued for, taken from the sub claim
+func (p *Payload) UserID() (int64, error) {
+	return strconv.ParseInt(p.Sub, 10, 64)
+}
+
+// ExpiresAt returns when the token expires
+func (p *Payload) ExpiresAt() time.Time {
+	return time.Unix(int64(p.Exp), 0)
+}
+
 // checks the validity of the session token payload
 func (g *Gopify) verifyPayload(pd *Payload) error {
-	now := time.Now().Unix()
-	if pd.Exp < int(now) || pd.Exp == 0 {
+	v := g.tokenVerifier()
+	now := int(v.now().Unix())
+	leeway := int(v.Leeway.Seconds())
+	if pd.Exp+leeway < now || pd.Exp == 0 {
 		return ErrTokenExpired
 	}
-	if pd.Nbf > int(now) || pd.Nbf == 0 {
+	if pd.Nbf-leeway > now || pd.Nbf == 0 {
 		return ErrInvalidToken
 	}
-	if pd.Iat > int(now) || pd.Iat == 0 {
+	if pd.Iat-leeway > now || pd.Iat == 0 {
 		return ErrInvalidToken
 	}
 	if pd.Aud != g.ApiKey {
@@ -69,34 +199,99 @@ func (g *Gopify) verifyPayload(pd *Payload) error {
 func (pd *Payload) validateShop() error {
 	iss, err := url.Parse(pd.Iss)
 	if err != nil {
-		return err
+		return ErrInvalidToken
 	}
 	dest, err := url.Parse(pd.Dest)
 	if err != nil {
-		return err
+		return ErrInvalidToken
 	}
 	if iss.Hostname() != dest.Hostname() {
 		return ErrInvalidToken
 	}
-	re, _ := regexp.Compile(`[a-zA-Z0-9][a-zA-Z0-9-]*\.myshopify\.com`)
-	if !re.MatchString(dest.Hostname()) {
+	if !ValidShop(dest.Hostname()) {
 		return ErrInvalidToken
 	}
 	return nil
 }
 
-// decodes the given session token and extracts the token payload from it
-func (g *Gopify) DecodeSessionToken(token string) (*Payload, error) {
+// tokenHeader is the JOSE header of a session token
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+// parsedToken is a session token split into its decoded parts
+type parsedToken struct {
+	header       tokenHeader
+	payload      []byte
+	signingInput string
+	signature    []byte
+}
+
+// parseSessionToken checks the structure of a session token and decodes its parts,
+// it returns a *MalformedTokenError for anything that isn't a well formed JWT
+func parseSessionToken(token string) (*parsedToken, error) {
 	parts := strings.Split(token, ".")
-	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if len(parts) != 3 {
+		return nil, &MalformedTokenError{Part: "token", Err: fmt.Errorf("expected 3 segments, got %d", len(parts))}
+	}
+	for _, part := range parts {
+		if part == "" {
+			return nil, &MalformedTokenError{Part: "token", Err: errors.New("empty segment")}
+		}
+	}
+
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, &MalformedTokenError{Part: "header", Err: err}
+	}
+	t := &parsedToken{
+		signingInput: parts[0] + "." + parts[1],
+	}
+	if err := json.Unmarshal(header, &t.header); err != nil {
+		return nil, &MalformedTokenError{Part: "header", Err: err}
+	}
+	t.payload, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, &MalformedTokenError{Part: "payload", Err: err}
+	}
+	t.signature, err = base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, &MalformedTokenError{Part: "signature", Err: err}
+	}
+	return t, nil
+}
+
+// verifySignature checks that the token is signed with HS256, the only algorithm shopify uses, and the app secret
+func (g *Gopify) verifySignature(t *parsedToken) error {
+	if t.header.Alg != "HS256" {
+		return ErrUnsupportedAlg
+	}
+	hasher := hmac.New(sha256.New, []byte(g.ApiSecret))
+	hasher.Write([]byte(t.signingInput))
+	if !hmac.Equal(hasher.Sum(nil), t.signature) {
+		return ErrSignatureInvalid
+	}
+	return nil
+}
+
+// DecodeSessionToken verifies the given session token and extracts the token payload from it.
+//
+// The header and signature are verified before any claim is trusted, then the claims are checked
+// according to g.TokenVerifier.
+func (g *Gopify) DecodeSessionToken(token string) (*Payload, error) {
+	t, err := parseSessionToken(token)
 	if err != nil {
 		return nil, err
 	}
+	if err := g.verifySignature(t); err != nil {
+		return nil, err
+	}
 
 	p := &Payload{}
 
-	if err := json.NewDecoder(bytes.NewBuffer(payload)).Decode(&p); err != nil {
-		return nil, err
+	if err := json.NewDecoder(bytes.NewBuffer(t.payload)).Decode(&p); err != nil {
+		return nil, &MalformedTokenError{Part: "payload", Err: err}
 	}
 
 	err = g.verifyPayload(p)
@@ -104,24 +299,44 @@ func (g *Gopify) DecodeSessionToken(token string) (*Payload, error) {
 		return nil, err
 	}
 
+	if cache := g.tokenVerifier().ReplayCache; cache != nil {
+		if cache.Seen(p.Jti, p.ExpiresAt().Add(g.tokenVerifier().Leeway)) {
+			return nil, ErrTokenReplayed
+		}
+	}
+
 	return p, nil
 }
 
 // VerifySignature verifies the signature of the session token
 func (g *Gopify) VerifyTokenSignature(token string) error {
-	parts := strings.Split(token, ".")
-	headerAndPayload := strings.Join(parts[:2], ".")
-	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	t, err := parseSessionToken(token)
 	if err != nil {
 		return err
 	}
-	hasher := hmac.New(sha256.New, []byte(g.ApiSecret))
-	hasher.Write([]byte(headerAndPayload))
-	if !hmac.Equal(hasher.Sum(nil), signature) {
-		return ErrSignatureInvalid
+	return g.verifySignature(t)
+}
+
+// tokenErrorStatus returns the http status code a session token verification error is reported with
+func tokenErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrMalformedToken), errors.Is(err, ErrInvalidToken), errors.Is(err, ErrUnsupportedAlg),
+		errors.Is(err, ErrNoTokenFound):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrTokenExpired), errors.Is(err, ErrSignatureInvalid), errors.Is(err, ErrTokenReplayed):
+		return http.StatusUnauthorized
 	}
+	return http.StatusInternalServerError
+}
 
-	return nil
+// tokenError responds with the status of a session token verification error
+func tokenError(w http.ResponseWriter, err error) {
+	status := tokenErrorStatus(err)
+	if status == http.StatusInternalServerError {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	http.Error(w, err.Error(), status)
 }
 
 func tokenFromHeader(r *http.Request) string {
@@ -141,26 +356,10 @@ func (g *Gopify) VerifyToken(next http.Handler) http.Handler {
 			return
 		}
 
-		// decode token
+		// decode and verify the token
 		payload, err := g.DecodeSessionToken(token)
-		if err == ErrInvalidToken {
-			http.Error(w, ErrInvalidToken.Error(), http.StatusBadRequest)
-			return
-		} else if err == ErrTokenExpired {
-			http.Error(w, ErrTokenExpired.Error(), http.StatusUnauthorized)
-			return
-		} else if err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
-		}
-
-		// verify signature
-		err = g.VerifyTokenSignature(token)
-		if err == ErrSignatureInvalid {
-			http.Error(w, ErrSignatureInvalid.Error(), http.StatusUnauthorized)
-			return
-		} else if err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		if err != nil {
+			tokenError(w, err)
 			return
 		}
 
@@ -1,26 +1,22 @@
 package gopify
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
 
 // create a session token for testing purposes
 func createToken(expired bool, key string, secret string) string {
-	h := map[string]string{
-		"alg": "HS256",
-		"typ": "JWT",
-	}
-	header, _ := json.Marshal(h)
-	headerEncoded := base64.RawURLEncoding.EncodeToString(header)
-
 	now := time.Now().Unix()
 	exp := int(now) + 60
 	if expired {
@@ -37,6 +33,18 @@ func createToken(expired bool, key string, secret string) string {
 		Jti:  "f8912129-1af6-4cad-9ca3-76b0f7621087",
 		Sid:  "aaea182f2732d44c23057c0fea584021a4485b2bd25d3eb7fd349313ad24c685",
 	}
+	return signToken("HS256", p, secret)
+}
+
+// sign a session token with the given header algorithm and payload
+func signToken(alg string, p Payload, secret string) string {
+	h := map[string]string{
+		"alg": alg,
+		"typ": "JWT",
+	}
+	header, _ := json.Marshal(h)
+	headerEncoded := base64.RawURLEncoding.EncodeToString(header)
+
 	payload, _ := json.Marshal(p)
 	payloadEncoded := base64.RawURLEncoding.EncodeToString(payload)
 
@@ -67,6 +75,8 @@ func TestVerifyToken(t *testing.T) {
 		{"", http.StatusBadRequest},
 		{invalidToken, http.StatusBadRequest},
 		{invalidSignatureToken, http.StatusUnauthorized},
+		{"a.b", http.StatusBadRequest},
+		{validToken + ".extra", http.StatusBadRequest},
 	}
 
 	mux := http.DefaultServeMux
@@ -86,3 +96,177 @@ func TestVerifyToken(t *testing.T) {
 		}
 	}
 }
+
+func TestTokenVerifier(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	payload := func(issuedAt time.Time) Payload {
+		return Payload{
+			Iss:  "https://shop-name.myshopify.com/admin",
+			Dest: "https://shop-name.myshopify.com",
+			Aud:  "key",
+			Sub:  "userid",
+			Exp:  int(issuedAt.Unix()) + 60,
+			Nbf:  int(issuedAt.Unix()),
+			Iat:  int(issuedAt.Unix()),
+			Jti:  issuedAt.String(),
+		}
+	}
+
+	cases := []struct {
+		token    string
+		verifier *TokenVerifier
+		expected error
+	}{
+		// issued 5 seconds in the future by a clock ahead of ours
+		{signToken("HS256", payload(now.Add(5*time.Second)), "hush"), &TokenVerifier{Now: func() time.Time { return now }}, ErrInvalidToken},
+		{signToken("HS256", payload(now.Add(5*time.Second)), "hush"), &TokenVerifier{Now: func() time.Time { return now }, Leeway: 10 * time.Second}, nil},
+		// expired 5 seconds ago
+		{signToken("HS256", payload(now.Add(-65*time.Second)), "hush"), &TokenVerifier{Now: func() time.Time { return now }}, ErrTokenExpired},
+		{signToken("HS256", payload(now.Add(-65*time.Second)), "hush"), &TokenVerifier{Now: func() time.Time { return now }, Leeway: 10 * time.Second}, nil},
+		{signToken("none", payload(now), "hush"), &TokenVerifier{Now: func() time.Time { return now }}, ErrUnsupportedAlg},
+		// the signature is checked before the claims
+		{signToken("HS256", payload(now.Add(-time.Hour)), "wrong"), &TokenVerifier{Now: func() time.Time { return now }}, ErrSignatureInvalid},
+	}
+
+	for i, c := range cases {
+		gopify := Gopify{ApiKey: "key", ApiSecret: "hush", TokenVerifier: c.verifier}
+		_, err := gopify.DecodeSessionToken(c.token)
+		if err != c.expected {
+			t.Errorf("case %d expected error %v got %v", i, c.expected, err)
+		}
+	}
+}
+
+func TestTokenReplay(t *testing.T) {
+	gopify := Gopify{
+		ApiKey:        "key",
+		ApiSecret:     "hush",
+		TokenVerifier: &TokenVerifier{ReplayCache: NewMemoryReplayCache()},
+	}
+	token := createToken(false, gopify.ApiKey, gopify.ApiSecret)
+
+	if _, err := gopify.DecodeSessionToken(token); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := gopify.DecodeSessionToken(token); err != ErrTokenReplayed {
+		t.Errorf("expected error %v got %v", ErrTokenReplayed, err)
+	}
+}
+
+func TestMemoryReplayCache(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := NewMemoryReplayCache()
+	c.now = func() time.Time { return now }
+
+	if c.Seen("a", now.Add(time.Minute)) || c.Seen("b", now.Add(2*time.Minute)) {
+		t.Errorf("expected new tokens not to be seen")
+	}
+	if !c.Seen("a", now.Add(time.Minute)) {
+		t.Errorf("expected a reused token to be seen")
+	}
+
+	// expired tokens are dropped, the others are kept
+	now = now.Add(90 * time.Second)
+	if c.Seen("c", now.Add(time.Minute)) {
+		t.Errorf("expected a new token not to be seen")
+	}
+	if len(c.entries) != 2 || c.order.Len() != 2 {
+		t.Errorf("expected the expired token to be dropped got %d entries", len(c.entries))
+	}
+	if !c.Seen("b", now.Add(time.Minute)) {
+		t.Errorf("expected a token that didn't expire to be seen")
+	}
+}
+
+func TestMalformedToken(t *testing.T) {
+	gopify := Gopify{ApiKey: "key", ApiSecret: "hush"}
+	valid := createToken(false, gopify.ApiKey, gopify.ApiSecret)
+	parts := strings.Split(valid, ".")
+	encode := func(s string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+
+	cases := []struct {
+		token string
+		part  string
+	}{
+		{"", "token"},
+		{"abc", "token"},
+		{"a.b", "token"},
+		{"..", "token"},
+		{parts[0] + "." + parts[1] + ".", "token"},
+		{valid + ".", "token"},
+		{"!!." + parts[1] + "." + parts[2], "header"},
+		{encode("not json") + "." + parts[1] + "." + parts[2], "header"},
+		{parts[0] + ".!!." + parts[2], "payload"},
+		{parts[0] + "." + parts[1] + ".!!", "signature"},
+	}
+
+	for i, c := range cases {
+		_, err := gopify.DecodeSessionToken(c.token)
+		var malformed *MalformedTokenError
+		if !errors.As(err, &malformed) || malformed.Part != c.part {
+			t.Errorf("case %d expected a malformed %s error got %v", i, c.part, err)
+		}
+		if !errors.Is(err, ErrMalformedToken) || tokenErrorStatus(err) != http.StatusBadRequest {
+			t.Errorf("case %d expected %v to be reported as a bad request", i, err)
+		}
+	}
+
+	// a payload that isn't json is only detected once the signature is verified
+	token := signRaw(parts[0], encode("not json"), gopify.ApiSecret)
+	if _, err := gopify.DecodeSessionToken(token); !errors.Is(err, ErrMalformedToken) {
+		t.Errorf("expected error %v got %v", ErrMalformedToken, err)
+	}
+}
+
+// signRaw signs already encoded token segments
+func signRaw(header, payload, secret string) string {
+	hasher := hmac.New(sha256.New, []byte(secret))
+	hasher.Write([]byte(header + "." + payload))
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(hasher.Sum(nil))
+}
+
+func FuzzDecodeSessionToken(f *testing.F) {
+	gopify := Gopify{ApiKey: "key", ApiSecret: "hush"}
+	valid := createToken(false, gopify.ApiKey, gopify.ApiSecret)
+	for _, seed := range []string{valid, "", "a", "a.b", "..", "a.b.c", valid + ".", signToken("none", Payload{}, "hush")} {
+		f.Add(seed)
+	}
+
+	known := []error{ErrMalformedToken, ErrInvalidToken, ErrTokenExpired, ErrSignatureInvalid, ErrUnsupportedAlg, ErrTokenReplayed}
+	f.Fuzz(func(t *testing.T, token string) {
+		_, err := gopify.DecodeSessionToken(token)
+		if err == nil {
+			return
+		}
+		for _, e := range known {
+			if errors.Is(err, e) {
+				return
+			}
+		}
+		t.Errorf("unexpected error %v for token %q", err, token)
+	})
+}
+
+func TestPayload(t *testing.T) {
+	p := &Payload{Dest: "https://shop-name.myshopify.com", Sub: "42", Exp: 1700000000}
+	ctx := context.WithValue(context.Background(), PayloadCtxKey, p)
+
+	got, ok := PayloadFromContext(ctx)
+	if !ok || got != p {
+		t.Fatalf("expected the payload from the context got %v", got)
+	}
+	if _, ok := PayloadFromContext(context.Background()); ok {
+		t.Errorf("expected no payload in an empty context")
+	}
+	if got.Shop() != "shop-name.myshopify.com" {
+		t.Errorf("expected shop-name.myshopify.com got %s", got.Shop())
+	}
+	if id, err := got.UserID(); err != nil || id != 42 {
+		t.Errorf("expected user 42 got %d, %v", id, err)
+	}
+	if !got.ExpiresAt().Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("unexpected expiry %v", got.ExpiresAt())
+	}
+}
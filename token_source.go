@@ -0,0 +1,123 @@
+package gopify
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// tokens are refreshed this long before they expire to account for clock skew and request latency
+	tokenExpiryDelta = time.Minute
+	// tokenRefreshTimeout bounds a refresh, which doesn't stop when the caller's context ends
+	tokenRefreshTimeout = 30 * time.Second
+)
+
+var (
+	ErrNoRefreshToken = errors.New("session has no refresh token")
+)
+
+// Token is an access token along with its expiry
+type Token struct {
+	AccessToken string
+	// Expiry is zero for tokens that don't expire
+	Expiry time.Time
+}
+
+// TokenSource supplies the access tokens used by a Client, see WithTokenSource.
+// A TokenSource that also has an Invalidate() method is told when its token was rejected.
+type TokenSource interface {
+	Token(ctx context.Context) (*Token, error)
+}
+
+// RefreshTokenSource is a TokenSource for an expiring offline session,
+// it refreshes the access token shortly before it expires. It is safe for concurrent use.
+type RefreshTokenSource struct {
+	g         *Gopify
+	mu        sync.Mutex
+	session   *Session
+	onRefresh func(ctx context.Context, s *Session) error
+	invalid   bool
+}
+
+// NewRefreshTokenSource creates a token source for the expiring offline session s.
+// onRefresh, if not nil, is called with every refreshed session so it can be stored, like SessionStore.Store.
+func (g *Gopify) NewRefreshTokenSource(s *Session, onRefresh func(ctx context.Context, s *Session) error) *RefreshTokenSource {
+	return &RefreshTokenSource{
+		g:         g,
+		session:   s,
+		onRefresh: onRefresh,
+	}
+}
+
+// Token returns the session access token, refreshing it first if it is about to expire or was invalidated.
+// A refresh isn't canceled along with ctx, so the new tokens are always stored.
+func (ts *RefreshTokenSource) Token(ctx context.Context) (*Token, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	expiring := !ts.session.Expires.IsZero() && time.Now().Add(tokenExpiryDelta).After(ts.session.Expires)
+	if expiring || ts.invalid {
+		if err := ts.refresh(); err != nil {
+			return nil, err
+		}
+	}
+	return &Token{
+		AccessToken: ts.session.AccessToken,
+		Expiry:      ts.session.Expires,
+	}, nil
+}
+
+// Session returns a copy of the current session, which holds the refreshed access token after a refresh
+func (ts *RefreshTokenSource) Session() *Session {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return copySession(ts.session)
+}
+
+// update replaces the session with s if s holds a newer access token,
+// like one refreshed by another process and loaded from the store
+func (ts *RefreshTokenSource) update(s *Session) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if s.Expires.After(ts.session.Expires) {
+		ts.session = s
+		ts.invalid = false
+	}
+}
+
+// Invalidate forces a refresh on the next call to Token
+func (ts *RefreshTokenSource) Invalidate() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.invalid = true
+}
+
+// refresh exchanges the refresh token for a new session and stores it with onRefresh.
+// It runs on its own context rather than the caller's: once shopify issued the new tokens the old refresh token
+// may be used up, so a canceled request must not drop them before they are stored.
+func (ts *RefreshTokenSource) refresh() error {
+	if ts.session.RefreshToken == "" {
+		return ErrNoRefreshToken
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tokenRefreshTimeout)
+	defer cancel()
+	res, err := ts.g.RefreshAccessToken(ctx, ts.session.Shop, ts.session.RefreshToken)
+	if err != nil {
+		return err
+	}
+	s := NewSession(ts.session.Shop, res)
+	if s.RefreshToken == "" {
+		s.RefreshToken = ts.session.RefreshToken
+		s.RefreshTokenExpires = ts.session.RefreshTokenExpires
+	}
+	if ts.onRefresh != nil {
+		if err := ts.onRefresh(ctx, s); err != nil {
+			return err
+		}
+	}
+	ts.session = s
+	ts.invalid = false
+	return nil
+}
@@ -0,0 +1,112 @@
+package gopify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRefreshTokenSource(t *testing.T) {
+	refreshes := 0
+	revoked := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/admin/oauth/access_token" {
+			params := map[string]string{}
+			json.NewDecoder(r.Body).Decode(&params)
+			if params["grant_type"] != "refresh_token" || params["refresh_token"] != fmt.Sprintf("refresh%d", refreshes) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error": "invalid_grant"}`)
+				return
+			}
+			refreshes++
+			revoked = false
+			fmt.Fprintf(w, `{"access_token": "token%d", "scope": "read_products", "expires_in": 3600, "refresh_token": "refresh%d", "refresh_token_expires_in": 7776000}`, refreshes, refreshes)
+			return
+		}
+		// only the latest token is accepted
+		if revoked || r.Header.Get("X-Shopify-Access-Token") != fmt.Sprintf("token%d", refreshes) {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"errors": "Invalid API key or access token"}`)
+			return
+		}
+		fmt.Fprint(w, `{"shop": {"name": "test"}}`)
+	}))
+	defer ts.Close()
+
+	gopify := &Gopify{
+		ApiKey:     "key",
+		ApiSecret:  "secret",
+		HttpClient: &http.Client{Transport: shopTransport{ts}},
+	}
+	session := &Session{
+		Shop:         "osama.myshopify.com",
+		AccessToken:  "token0",
+		Expires:      time.Now().Add(30 * time.Second),
+		RefreshToken: "refresh0",
+	}
+	store := NewMemorySessionStore()
+	source := gopify.NewRefreshTokenSource(session, store.Store)
+
+	// the token expires in less than a minute so it is refreshed right away
+	token, err := source.Token(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if token.AccessToken != "token1" || refreshes != 1 {
+		t.Errorf("expected the token to be refreshed got %s", token.AccessToken)
+	}
+	stored, err := store.Load(context.Background(), OfflineSessionID("osama.myshopify.com"))
+	if err != nil || stored.RefreshToken != "refresh1" || stored.Expires.IsZero() {
+		t.Errorf("expected the refreshed session to be stored got %+v, %v", stored, err)
+	}
+
+	// the token is revoked on shopify's side, the client refreshes it after the 401 and retries
+	revoked = true
+	apiClient := NewClient(ts.URL[7:], "", WithTokenSource(source))
+	apiClient.baseUrl = fmt.Sprintf("%s/admin/api/%s", ts.URL, apiClient.version)
+	res := map[string]any{}
+	_, err = apiClient.GetCtx(context.Background(), "shop.json", nil, &res)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if refreshes != 2 || fmt.Sprint(res) != "map[shop:map[name:test]]" {
+		t.Errorf("expected the request to succeed after a refresh got %d refreshes and %v", refreshes, res)
+	}
+}
+
+func TestRefreshTokenSourceCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the caller gives up after shopify issued the new tokens
+		cancel()
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprint(w, `{"access_token": "token1", "expires_in": 3600, "refresh_token": "refresh1"}`)
+	}))
+	defer ts.Close()
+
+	gopify := &Gopify{
+		ApiKey:     "key",
+		ApiSecret:  "secret",
+		HttpClient: &http.Client{Transport: shopTransport{ts}},
+	}
+	store := NewMemorySessionStore()
+	source := gopify.NewRefreshTokenSource(&Session{
+		Shop:         "osama.myshopify.com",
+		AccessToken:  "token0",
+		Expires:      time.Now().Add(-time.Hour),
+		RefreshToken: "refresh0",
+	}, store.Store)
+
+	if _, err := source.Token(ctx); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	stored, err := store.Load(context.Background(), OfflineSessionID("osama.myshopify.com"))
+	if err != nil || stored.AccessToken != "token1" || stored.RefreshToken != "refresh1" {
+		t.Errorf("expected the refreshed session to be stored got %+v, %v", stored, err)
+	}
+}
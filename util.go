@@ -1,8 +1,10 @@
 package gopify
 
 import (
+	"context"
 	"crypto/rand"
 	"strings"
+	"time"
 )
 
 func uniqueToken(size int) string {
@@ -17,3 +19,18 @@ func uniqueToken(size int) string {
 
 	return b.String()
 }
+
+// sleep pauses for the duration d or until ctx is done, whichever comes first
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
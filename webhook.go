@@ -1,32 +1,286 @@
 package gopify
 
 import (
+	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
-	"encoding/hex"
 	"errors"
-	"io/ioutil"
+	"fmt"
+	"io"
 	"net/http"
+	"sync"
+	"time"
 )
 
 const (
-	ShopifyHmacHeader = "X-Shopify-Hmac-SHA256"
+	ShopifyHmacHeader        = "X-Shopify-Hmac-SHA256"
+	ShopifyTopicHeader       = "X-Shopify-Topic"
+	ShopifyShopDomainHeader  = "X-Shopify-Shop-Domain"
+	ShopifyWebhookIdHeader   = "X-Shopify-Webhook-Id"
+	ShopifyEventIdHeader     = "X-Shopify-Event-Id"
+	ShopifyApiVersionHeader  = "X-Shopify-API-Version"
+	ShopifyTriggeredAtHeader = "X-Shopify-Triggered-At"
 )
 
 var (
 	ErrInvalidWebhookRequest = errors.New("webhook request is unauthorized")
+	ErrNoWebhookHandler      = errors.New("no handler for the webhook topic")
+	ErrWebhookTooLarge       = errors.New("webhook request body is too large")
 )
 
-// VerifyWebhook verifies that webhook request is from shopify
-func (g *Gopify) VerifyWebhook(r *http.Request) bool {
-	mac := r.Header.Get(ShopifyHmacHeader)
-	body, _ := ioutil.ReadAll(r.Body)
+// defaultMaxWebhookBodySize is the webhook body size limit when Gopify.MaxWebhookBodySize is zero
+const defaultMaxWebhookBodySize = 10 << 20
 
-	hasher := hmac.New(sha256.New, []byte(g.ApiSecret))
-	hasher.Write(body)
-	validMac := hex.EncodeToString(hasher.Sum(nil))
-	validMac = base64.StdEncoding.EncodeToString([]byte(validMac))
+// VerifyWebhook verifies that webhook request is from shopify, by checking the base64 encoded hmac of the body
+// in the X-Shopify-Hmac-SHA256 header against g.ApiSecret and g.OldApiSecrets.
+// It returns ErrWebhookTooLarge when the body is bigger than g.MaxWebhookBodySize
+// and an error wrapping ErrInvalidWebhookRequest when the hmac is missing or wrong.
+// The request body is left unread for the next handlers.
+func (g *Gopify) VerifyWebhook(r *http.Request) error {
+	header := r.Header.Get(ShopifyHmacHeader)
+	if header == "" {
+		return fmt.Errorf("%w: missing %s header", ErrInvalidWebhookRequest, ShopifyHmacHeader)
+	}
+	mac, err := base64.StdEncoding.DecodeString(header)
+	if err != nil {
+		return fmt.Errorf("%w: malformed %s header", ErrInvalidWebhookRequest, ShopifyHmacHeader)
+	}
 
-	return hmac.Equal([]byte(validMac), []byte(mac))
+	body, err := g.readWebhookBody(r)
+	if err != nil {
+		return err
+	}
+
+	for _, secret := range append([]string{g.ApiSecret}, g.OldApiSecrets...) {
+		hasher := hmac.New(sha256.New, []byte(secret))
+		hasher.Write(body)
+		if hmac.Equal(hasher.Sum(nil), mac) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: hmac doesn't match", ErrInvalidWebhookRequest)
+}
+
+// readWebhookBody reads the body of r up to g.MaxWebhookBodySize, and puts it back for the next handlers
+func (g *Gopify) readWebhookBody(r *http.Request) ([]byte, error) {
+	limit := g.MaxWebhookBodySize
+	if limit <= 0 {
+		limit = defaultMaxWebhookBodySize
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, ErrWebhookTooLarge
+	}
+	return body, nil
+}
+
+// webhookErrorStatus returns the http status code a webhook verification error is reported with
+func webhookErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrWebhookTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrInvalidWebhookRequest):
+		return http.StatusUnauthorized
+	}
+	return http.StatusBadRequest
+}
+
+// WebhookEvent is a webhook delivered by shopify
+type WebhookEvent struct {
+	Topic      string
+	Shop       string
+	WebhookID  string
+	EventID    string
+	ApiVersion string
+	// TriggeredAt is when the event that triggered the webhook happened, it is zero when the header is missing
+	TriggeredAt time.Time
+	Body        []byte
+}
+
+// ParseWebhookEvent reads the webhook event from the headers and body of r,
+// it returns ErrWebhookTooLarge when the body is bigger than g.MaxWebhookBodySize.
+// The request body is left unread for the next handlers.
+func (g *Gopify) ParseWebhookEvent(r *http.Request) (*WebhookEvent, error) {
+	body, err := g.readWebhookBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &WebhookEvent{
+		Topic:      r.Header.Get(ShopifyTopicHeader),
+		Shop:       r.Header.Get(ShopifyShopDomainHeader),
+		WebhookID:  r.Header.Get(ShopifyWebhookIdHeader),
+		EventID:    r.Header.Get(ShopifyEventIdHeader),
+		ApiVersion: r.Header.Get(ShopifyApiVersionHeader),
+		Body:       body,
+	}
+	if triggeredAt := r.Header.Get(ShopifyTriggeredAtHeader); triggeredAt != "" {
+		e.TriggeredAt, _ = time.Parse(time.RFC3339Nano, triggeredAt)
+	}
+	return e, nil
+}
+
+// WebhookHandlerFunc handles a webhook event, returning an error makes shopify deliver it again later
+type WebhookHandlerFunc func(ctx context.Context, e *WebhookEvent) error
+
+// WebhookHandler is an http handler that verifies webhook requests and dispatches them to the handler of their topic
+type WebhookHandler struct {
+	g        *Gopify
+	mu       sync.RWMutex
+	handlers map[string]WebhookHandlerFunc
+	fallback WebhookHandlerFunc
+}
+
+// NewWebhookHandler creates a webhook handler without any topic handler
+func (g *Gopify) NewWebhookHandler() *WebhookHandler {
+	return &WebhookHandler{
+		g:        g,
+		handlers: make(map[string]WebhookHandlerFunc),
+	}
+}
+
+// Handle registers the handler of topic, like orders/create
+func (h *WebhookHandler) Handle(topic string, fn WebhookHandlerFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.handlers[topic] = fn
+}
+
+// HandleDefault registers the handler of the topics without a handler
+func (h *WebhookHandler) HandleDefault(fn WebhookHandlerFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.fallback = fn
+}
+
+// Dispatch calls the handler of the event topic, or the default handler,
+// it returns ErrNoWebhookHandler when there is none
+func (h *WebhookHandler) Dispatch(ctx context.Context, e *WebhookEvent) error {
+	h.mu.RLock()
+	fn, ok := h.handlers[e.Topic]
+	if !ok {
+		fn = h.fallback
+	}
+	h.mu.RUnlock()
+	if fn == nil {
+		return ErrNoWebhookHandler
+	}
+	return fn(ctx, e)
+}
+
+// ServeHTTP verifies the webhook request and dispatches its event.
+// It responds with 401 to invalid requests, 413 to bodies over the size limit and 500 when the handler fails,
+// so shopify retries the delivery. Events of topics without a handler are acknowledged with 200,
+// since shopify would retry them for 48 hours and could remove the subscription.
+func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h.g.VerifyWebhook(r); err != nil {
+		status := webhookErrorStatus(err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	e, err := h.g.ParseWebhookEvent(r)
+	if err != nil {
+		status := webhookErrorStatus(err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	if err := h.Dispatch(r.Context(), e); err != nil && !errors.Is(err, ErrNoWebhookHandler) {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// defaultWebhookTTL covers the 48 hours during which shopify retries a failed webhook
+const defaultWebhookTTL = 48 * time.Hour
+
+// statusRecorder records the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// webhookKeys returns the store keys of a webhook event, its webhook id and event id when there is one
+func webhookKeys(e *WebhookEvent) []string {
+	keys := []string{"webhook:" + e.WebhookID}
+	if e.EventID != "" {
+		keys = append(keys, "event:"+e.Topic+":"+e.EventID)
+	}
+	return keys
+}
+
+// DeduplicateWebhooks returns a middleware that verifies webhook requests and lets each webhook through only once,
+// by reserving its X-Shopify-Webhook-Id and X-Shopify-Event-Id in store for ttl, 48 hours when zero.
+// Duplicates get a 200 without calling next, and the reservation is released when next responds with an error
+// status so the webhook is handled again when shopify retries it.
+func (g *Gopify) DeduplicateWebhooks(store WebhookStore, ttl time.Duration, next http.Handler) http.Handler {
+	if ttl <= 0 {
+		ttl = defaultWebhookTTL
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := g.VerifyWebhook(r); err != nil {
+			status := webhookErrorStatus(err)
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		e, err := g.ParseWebhookEvent(r)
+		if err != nil {
+			status := webhookErrorStatus(err)
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		if e.WebhookID == "" {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		reserved := []string{}
+		release := func() {
+			for _, key := range reserved {
+				store.Release(context.Background(), key)
+			}
+		}
+		for _, key := range webhookKeys(e) {
+			ok, err := store.Reserve(r.Context(), key, ttl)
+			if err != nil {
+				release()
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				release()
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			reserved = append(reserved, key)
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status >= http.StatusMultipleChoices {
+			release()
+		}
+	})
 }
@@ -0,0 +1,274 @@
+package gopify
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// webhook topics with a typed payload
+const (
+	TopicOrdersCreate          = "orders/create"
+	TopicOrdersPaid            = "orders/paid"
+	TopicProductsUpdate        = "products/update"
+	TopicAppUninstalled        = "app/uninstalled"
+	TopicCustomersRedact       = "customers/redact"
+	TopicShopRedact            = "shop/redact"
+	TopicCustomersDataRequest  = "customers/data_request"
+	TopicInventoryLevelsUpdate = "inventory_levels/update"
+)
+
+// Address is a shipping or billing address
+type Address struct {
+	FirstName    string `json:"first_name"`
+	LastName     string `json:"last_name"`
+	Company      string `json:"company"`
+	Address1     string `json:"address1"`
+	Address2     string `json:"address2"`
+	City         string `json:"city"`
+	Province     string `json:"province"`
+	ProvinceCode string `json:"province_code"`
+	Country      string `json:"country"`
+	CountryCode  string `json:"country_code"`
+	Zip          string `json:"zip"`
+	Phone        string `json:"phone"`
+}
+
+// Customer is the customer of an order
+type Customer struct {
+	ID        int64  `json:"id"`
+	Email     string `json:"email"`
+	Phone     string `json:"phone"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+// LineItem is a product variant bought in an order
+type LineItem struct {
+	ID           int64  `json:"id"`
+	ProductID    int64  `json:"product_id"`
+	VariantID    int64  `json:"variant_id"`
+	Title        string `json:"title"`
+	VariantTitle string `json:"variant_title"`
+	SKU          string `json:"sku"`
+	Vendor       string `json:"vendor"`
+	Quantity     int    `json:"quantity"`
+	Price        string `json:"price"`
+}
+
+// Order is the payload of the orders/create and orders/paid webhooks
+type Order struct {
+	ID                int64      `json:"id"`
+	AdminGraphqlApiID string     `json:"admin_graphql_api_id"`
+	Name              string     `json:"name"`
+	OrderNumber       int        `json:"order_number"`
+	Email             string     `json:"email"`
+	Currency          string     `json:"currency"`
+	TotalPrice        string     `json:"total_price"`
+	SubtotalPrice     string     `json:"subtotal_price"`
+	TotalTax          string     `json:"total_tax"`
+	FinancialStatus   string     `json:"financial_status"`
+	FulfillmentStatus string     `json:"fulfillment_status"`
+	Note              string     `json:"note"`
+	Tags              string     `json:"tags"`
+	Test              bool       `json:"test"`
+	Customer          *Customer  `json:"customer"`
+	LineItems         []LineItem `json:"line_items"`
+	ShippingAddress   *Address   `json:"shipping_address"`
+	BillingAddress    *Address   `json:"billing_address"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+	CancelledAt       *time.Time `json:"cancelled_at"`
+	// Extra holds the fields of the payload without a struct field
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+func (o *Order) UnmarshalJSON(b []byte) error {
+	type order Order
+	return unmarshalWithExtra(b, (*order)(o), &o.Extra)
+}
+
+// ProductVariant is a variant of a product
+type ProductVariant struct {
+	ID                int64  `json:"id"`
+	ProductID         int64  `json:"product_id"`
+	Title             string `json:"title"`
+	Price             string `json:"price"`
+	SKU               string `json:"sku"`
+	Position          int    `json:"position"`
+	InventoryItemID   int64  `json:"inventory_item_id"`
+	InventoryQuantity int    `json:"inventory_quantity"`
+}
+
+// Product is the payload of the products/update webhook
+type Product struct {
+	ID                int64            `json:"id"`
+	AdminGraphqlApiID string           `json:"admin_graphql_api_id"`
+	Title             string           `json:"title"`
+	BodyHTML          string           `json:"body_html"`
+	Vendor            string           `json:"vendor"`
+	ProductType       string           `json:"product_type"`
+	Handle            string           `json:"handle"`
+	Status            string           `json:"status"`
+	Tags              string           `json:"tags"`
+	Variants          []ProductVariant `json:"variants"`
+	CreatedAt         time.Time        `json:"created_at"`
+	UpdatedAt         time.Time        `json:"updated_at"`
+	PublishedAt       *time.Time       `json:"published_at"`
+	// Extra holds the fields of the payload without a struct field
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+func (p *Product) UnmarshalJSON(b []byte) error {
+	type product Product
+	return unmarshalWithExtra(b, (*product)(p), &p.Extra)
+}
+
+// Shop is the payload of the app/uninstalled webhook
+type Shop struct {
+	ID              int64  `json:"id"`
+	Name            string `json:"name"`
+	Email           string `json:"email"`
+	Domain          string `json:"domain"`
+	MyshopifyDomain string `json:"myshopify_domain"`
+	PlanName        string `json:"plan_name"`
+	Country         string `json:"country"`
+	Currency        string `json:"currency"`
+	IanaTimezone    string `json:"iana_timezone"`
+	// Extra holds the fields of the payload without a struct field
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+func (s *Shop) UnmarshalJSON(b []byte) error {
+	type shop Shop
+	return unmarshalWithExtra(b, (*shop)(s), &s.Extra)
+}
+
+// CustomersRedact is the payload of the customers/redact webhook, asking to delete the data of a customer
+type CustomersRedact struct {
+	ShopID         int64    `json:"shop_id"`
+	ShopDomain     string   `json:"shop_domain"`
+	Customer       Customer `json:"customer"`
+	OrdersToRedact []int64  `json:"orders_to_redact"`
+	// Extra holds the fields of the payload without a struct field
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+func (c *CustomersRedact) UnmarshalJSON(b []byte) error {
+	type customersRedact CustomersRedact
+	return unmarshalWithExtra(b, (*customersRedact)(c), &c.Extra)
+}
+
+// ShopRedact is the payload of the shop/redact webhook, asking to delete the data of a shop
+type ShopRedact struct {
+	ShopID     int64  `json:"shop_id"`
+	ShopDomain string `json:"shop_domain"`
+	// Extra holds the fields of the payload without a struct field
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+func (s *ShopRedact) UnmarshalJSON(b []byte) error {
+	type shopRedact ShopRedact
+	return unmarshalWithExtra(b, (*shopRedact)(s), &s.Extra)
+}
+
+// CustomersDataRequest is the payload of the customers/data_request webhook, asking for the data of a customer
+type CustomersDataRequest struct {
+	ShopID          int64    `json:"shop_id"`
+	ShopDomain      string   `json:"shop_domain"`
+	Customer        Customer `json:"customer"`
+	OrdersRequested []int64  `json:"orders_requested"`
+	DataRequest     struct {
+		ID int64 `json:"id"`
+	} `json:"data_request"`
+	// Extra holds the fields of the payload without a struct field
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+func (c *CustomersDataRequest) UnmarshalJSON(b []byte) error {
+	type customersDataRequest CustomersDataRequest
+	return unmarshalWithExtra(b, (*customersDataRequest)(c), &c.Extra)
+}
+
+// InventoryLevel is the payload of the inventory_levels/update webhook
+type InventoryLevel struct {
+	InventoryItemID   int64     `json:"inventory_item_id"`
+	LocationID        int64     `json:"location_id"`
+	Available         *int      `json:"available"`
+	UpdatedAt         time.Time `json:"updated_at"`
+	AdminGraphqlApiID string    `json:"admin_graphql_api_id"`
+	// Extra holds the fields of the payload without a struct field
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+func (l *InventoryLevel) UnmarshalJSON(b []byte) error {
+	type inventoryLevel InventoryLevel
+	return unmarshalWithExtra(b, (*inventoryLevel)(l), &l.Extra)
+}
+
+// unmarshalWithExtra decodes b into the struct pointed to by v,
+// and the fields of b that don't match a field of v into extra
+func unmarshalWithExtra(b []byte, v any, extra *map[string]json.RawMessage) error {
+	if err := json.Unmarshal(b, v); err != nil {
+		return err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+
+	t := reflect.TypeOf(v).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		for field := range fields {
+			// encoding/json matches field names case insensitively
+			if strings.EqualFold(field, name) {
+				delete(fields, field)
+			}
+		}
+	}
+	*extra = nil
+	if len(fields) > 0 {
+		*extra = fields
+	}
+	return nil
+}
+
+// Decode decodes the body of the event into the payload type of its topic, like *Order for orders/create.
+// The body of other topics is decoded into a map[string]any.
+func (e *WebhookEvent) Decode() (any, error) {
+	var v any
+	switch e.Topic {
+	case TopicOrdersCreate, TopicOrdersPaid:
+		v = &Order{}
+	case TopicProductsUpdate:
+		v = &Product{}
+	case TopicAppUninstalled:
+		v = &Shop{}
+	case TopicCustomersRedact:
+		v = &CustomersRedact{}
+	case TopicShopRedact:
+		v = &ShopRedact{}
+	case TopicCustomersDataRequest:
+		v = &CustomersDataRequest{}
+	case TopicInventoryLevelsUpdate:
+		v = &InventoryLevel{}
+	default:
+		m := map[string]any{}
+		if err := json.Unmarshal(e.Body, &m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	if err := json.Unmarshal(e.Body, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
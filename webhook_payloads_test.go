@@ -0,0 +1,106 @@
+package gopify
+
+import (
+	"testing"
+)
+
+func TestWebhookEventDecode(t *testing.T) {
+	cases := []struct {
+		topic string
+		body  string
+		check func(v any) bool
+	}{
+		{
+			TopicOrdersCreate,
+			`{"id": 820982911946154508, "name": "#9999", "total_price": "403.00", "cancelled_at": null, "created_at": "2021-12-31T19:00:00-05:00",
+				"customer": {"id": 115310627314723954, "email": "john@example.com"}, "line_items": [{"id": 866550311766439020, "quantity": 1, "price": "199.00"}],
+				"payment_terms": null, "source_name": "web"}`,
+			func(v any) bool {
+				o, ok := v.(*Order)
+				return ok && o.ID == 820982911946154508 && o.Name == "#9999" && o.Customer.Email == "john@example.com" &&
+					len(o.LineItems) == 1 && o.LineItems[0].Price == "199.00" && o.CancelledAt == nil && o.CreatedAt.Year() == 2021 &&
+					len(o.Extra) == 2 && string(o.Extra["source_name"]) == `"web"`
+			},
+		},
+		{
+			TopicOrdersPaid,
+			`{"id": 1, "financial_status": "paid"}`,
+			func(v any) bool {
+				o, ok := v.(*Order)
+				return ok && o.FinancialStatus == "paid" && o.Extra == nil
+			},
+		},
+		{
+			TopicProductsUpdate,
+			`{"id": 788032119674292922, "title": "Example T-Shirt", "variants": [{"id": 642667041472713922, "price": "19.99"}], "options": []}`,
+			func(v any) bool {
+				p, ok := v.(*Product)
+				return ok && p.Title == "Example T-Shirt" && len(p.Variants) == 1 && p.Variants[0].Price == "19.99" && p.Extra["options"] != nil
+			},
+		},
+		{
+			TopicAppUninstalled,
+			`{"id": 548380009, "name": "Super Toys", "myshopify_domain": "example.myshopify.com"}`,
+			func(v any) bool {
+				s, ok := v.(*Shop)
+				return ok && s.MyshopifyDomain == "example.myshopify.com"
+			},
+		},
+		{
+			TopicCustomersRedact,
+			`{"shop_id": 954889, "shop_domain": "example.myshopify.com", "customer": {"id": 191167, "email": "john@example.com"}, "orders_to_redact": [299938, 280263]}`,
+			func(v any) bool {
+				c, ok := v.(*CustomersRedact)
+				return ok && c.Customer.ID == 191167 && len(c.OrdersToRedact) == 2
+			},
+		},
+		{
+			TopicShopRedact,
+			`{"shop_id": 954889, "shop_domain": "example.myshopify.com"}`,
+			func(v any) bool {
+				s, ok := v.(*ShopRedact)
+				return ok && s.ShopID == 954889
+			},
+		},
+		{
+			TopicCustomersDataRequest,
+			`{"shop_id": 954889, "shop_domain": "example.myshopify.com", "orders_requested": [299938], "customer": {"id": 191167}, "data_request": {"id": 9999}}`,
+			func(v any) bool {
+				c, ok := v.(*CustomersDataRequest)
+				return ok && c.DataRequest.ID == 9999 && len(c.OrdersRequested) == 1
+			},
+		},
+		{
+			TopicInventoryLevelsUpdate,
+			`{"inventory_item_id": 271878346596884015, "location_id": 24826418, "available": 0, "updated_at": "2021-12-31T19:00:00-05:00"}`,
+			func(v any) bool {
+				l, ok := v.(*InventoryLevel)
+				return ok && l.LocationID == 24826418 && l.Available != nil && *l.Available == 0
+			},
+		},
+		{
+			"carts/create",
+			`{"id": "cart"}`,
+			func(v any) bool {
+				m, ok := v.(map[string]any)
+				return ok && m["id"] == "cart"
+			},
+		},
+	}
+
+	for i, c := range cases {
+		e := &WebhookEvent{Topic: c.topic, Body: []byte(c.body)}
+		v, err := e.Decode()
+		if err != nil {
+			t.Errorf("case %d unexpected error %v", i, err)
+			continue
+		}
+		if !c.check(v) {
+			t.Errorf("case %d unexpected payload %+v", i, v)
+		}
+	}
+
+	if _, err := (&WebhookEvent{Topic: TopicOrdersCreate, Body: []byte("not json")}).Decode(); err == nil {
+		t.Errorf("expected an error decoding an invalid body")
+	}
+}
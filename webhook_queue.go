@@ -0,0 +1,194 @@
+package gopify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	ErrWebhookQueueFull   = errors.New("webhook queue is full")
+	ErrWebhookQueueClosed = errors.New("webhook queue is shut down")
+)
+
+// WebhookQueueOptions configures a WebhookQueue
+type WebhookQueueOptions struct {
+	// Workers is the number of events handled concurrently, 4 when zero
+	Workers int
+	// QueueSize is the number of events waiting for each worker, 100 when zero
+	QueueSize int
+	// MaxAttempts is the number of times an event is handled before it is given up, 5 when zero
+	MaxAttempts int
+	// Backoff returns how long to wait before the next attempt after the given failed attempt,
+	// it doubles from one second up to a minute when nil
+	Backoff func(attempt int) time.Duration
+	// DeadLetter is called with the events that failed every attempt, or were left when the queue was shut down
+	DeadLetter func(ctx context.Context, e *WebhookEvent, err error)
+}
+
+func defaultWebhookBackoff(attempt int) time.Duration {
+	d := time.Second << (attempt - 1)
+	if d <= 0 || d > time.Minute {
+		return time.Minute
+	}
+	return d
+}
+
+// WebhookQueue is an http handler that verifies webhook requests, queues their events and responds right away,
+// so slow handlers don't make shopify time out the delivery.
+// Events are handled by a pool of workers, the events of a shop are handled in order by the same worker.
+type WebhookQueue struct {
+	g      *Gopify
+	fn     WebhookHandlerFunc
+	opts   WebhookQueueOptions
+	mu     sync.RWMutex
+	closed bool
+	shards []chan *WebhookEvent
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewWebhookQueue creates a webhook queue handling events with fn, like WebhookHandler.Dispatch,
+// and starts its workers. Call Shutdown to stop them.
+func (g *Gopify) NewWebhookQueue(fn WebhookHandlerFunc, opts WebhookQueueOptions) *WebhookQueue {
+	if opts.Workers <= 0 {
+		opts.Workers = 4
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 100
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 5
+	}
+	if opts.Backoff == nil {
+		opts.Backoff = defaultWebhookBackoff
+	}
+
+	q := &WebhookQueue{
+		g:      g,
+		fn:     fn,
+		opts:   opts,
+		shards: make([]chan *WebhookEvent, opts.Workers),
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	for i := range q.shards {
+		q.shards[i] = make(chan *WebhookEvent, opts.QueueSize)
+		q.wg.Add(1)
+		go q.work(q.shards[i])
+	}
+	return q
+}
+
+// Enqueue queues e for the worker of its shop,
+// it returns ErrWebhookQueueFull when the worker has too many events waiting and ErrWebhookQueueClosed after Shutdown
+func (q *WebhookQueue) Enqueue(e *WebhookEvent) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrWebhookQueueClosed
+	}
+	h := fnv.New32a()
+	h.Write([]byte(e.Shop))
+	select {
+	case q.shards[h.Sum32()%uint32(len(q.shards))] <- e:
+		return nil
+	default:
+		return ErrWebhookQueueFull
+	}
+}
+
+// ServeHTTP verifies the webhook request and queues its event, responding with 200 once it's queued.
+// It responds with 503 when the event can't be queued so shopify delivers it again later.
+func (q *WebhookQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := q.g.VerifyWebhook(r); err != nil {
+		status := webhookErrorStatus(err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	e, err := q.g.ParseWebhookEvent(r)
+	if err != nil {
+		status := webhookErrorStatus(err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if err := q.Enqueue(e); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (q *WebhookQueue) work(events <-chan *WebhookEvent) {
+	defer q.wg.Done()
+	for e := range events {
+		q.handle(e)
+	}
+}
+
+// handle calls the handler of e until it succeeds or runs out of attempts, a panic counts as a failed attempt.
+// Events of topics without a handler are dropped without retrying them
+func (q *WebhookQueue) handle(e *WebhookEvent) {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = q.ctx.Err(); err != nil {
+			break
+		}
+		err = q.call(e)
+		if err == nil || errors.Is(err, ErrNoWebhookHandler) {
+			return
+		}
+		if attempt == q.opts.MaxAttempts {
+			break
+		}
+		if sleep(q.ctx, q.opts.Backoff(attempt)) != nil {
+			break
+		}
+	}
+	if q.opts.DeadLetter != nil {
+		q.opts.DeadLetter(context.Background(), e, err)
+	}
+}
+
+// call handles e, turning a panic of the handler into an error so it doesn't crash the worker
+func (q *WebhookQueue) call(e *WebhookEvent) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("webhook handler panicked: %v", r)
+		}
+	}()
+	return q.fn(q.ctx, e)
+}
+
+// Shutdown stops accepting events and waits for the queued ones to be handled.
+// When ctx is done first, the handlers' context is canceled, which they should return on,
+// the events left are given to the dead letter hook and the ctx error is returned.
+func (q *WebhookQueue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		for _, shard := range q.shards {
+			close(shard)
+		}
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		q.cancel()
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
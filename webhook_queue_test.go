@@ -0,0 +1,136 @@
+package gopify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookQueue(t *testing.T) {
+	gopify := &Gopify{ApiKey: "key", ApiSecret: "hush"}
+	var (
+		mu       sync.Mutex
+		handled  = map[string][]string{}
+		attempts = map[string]int{}
+		dead     []string
+		deadErr  error
+	)
+	q := gopify.NewWebhookQueue(func(ctx context.Context, e *WebhookEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[e.WebhookID]++
+		switch {
+		case e.WebhookID == "always":
+			return errors.New("failed")
+		case e.WebhookID == "unhandled":
+			return ErrNoWebhookHandler
+		case e.WebhookID == "panic":
+			panic("boom")
+		case e.WebhookID == "a2" && attempts[e.WebhookID] < 3:
+			return errors.New("failed")
+		}
+		handled[e.Shop] = append(handled[e.Shop], e.WebhookID)
+		return nil
+	}, WebhookQueueOptions{
+		Workers:     2,
+		MaxAttempts: 3,
+		Backoff:     func(attempt int) time.Duration { return time.Millisecond },
+		DeadLetter: func(ctx context.Context, e *WebhookEvent, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			dead = append(dead, e.WebhookID)
+			if e.WebhookID == "panic" {
+				deadErr = err
+			}
+		},
+	})
+
+	for i := 1; i <= 5; i++ {
+		for _, shop := range []string{"a", "b"} {
+			req := newWebhookRequest("orders/create", `{}`, "hush")
+			req.Header.Set(ShopifyShopDomainHeader, shop)
+			req.Header.Set(ShopifyWebhookIdHeader, fmt.Sprintf("%s%d", shop, i))
+			rec := httptest.NewRecorder()
+			q.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected %d status code but got %d", http.StatusOK, rec.Code)
+			}
+		}
+	}
+	if err := q.Enqueue(&WebhookEvent{Shop: "c", WebhookID: "always"}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := q.Enqueue(&WebhookEvent{Shop: "c", WebhookID: "unhandled"}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := q.Enqueue(&WebhookEvent{Shop: "c", WebhookID: "panic"}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if err := q.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// the events of a shop are handled in order, even when one is retried
+	if fmt.Sprint(handled["a"]) != "[a1 a2 a3 a4 a5]" || fmt.Sprint(handled["b"]) != "[b1 b2 b3 b4 b5]" {
+		t.Errorf("unexpected handled events %v", handled)
+	}
+	// events without a handler aren't retried, a panic is retried like an error
+	if attempts["a2"] != 3 || attempts["always"] != 3 || attempts["unhandled"] != 1 || attempts["panic"] != 3 ||
+		fmt.Sprint(dead) != "[always panic]" {
+		t.Errorf("unexpected attempts %v and dead letters %v", attempts, dead)
+	}
+	if deadErr == nil || !strings.Contains(deadErr.Error(), "boom") {
+		t.Errorf("expected the panic as the dead letter error got %v", deadErr)
+	}
+
+	rec := httptest.NewRecorder()
+	q.ServeHTTP(rec, newWebhookRequest("orders/create", `{}`, "hush"))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected %d status code after shutdown but got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+}
+
+func TestWebhookQueueShutdownTimeout(t *testing.T) {
+	gopify := &Gopify{ApiKey: "key", ApiSecret: "hush"}
+	dead := make(chan error, 3)
+	started := make(chan struct{}, 3)
+	q := gopify.NewWebhookQueue(func(ctx context.Context, e *WebhookEvent) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	}, WebhookQueueOptions{
+		Workers:   1,
+		QueueSize: 2,
+		DeadLetter: func(ctx context.Context, e *WebhookEvent, err error) {
+			dead <- err
+		},
+	})
+
+	// the worker takes the first event, the next two wait and the last doesn't fit
+	for i := 0; i < 3; i++ {
+		if err := q.Enqueue(&WebhookEvent{Shop: "a"}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if i == 0 {
+			<-started
+		}
+	}
+	if err := q.Enqueue(&WebhookEvent{Shop: "a"}); err != ErrWebhookQueueFull {
+		t.Errorf("expected error %v got %v", ErrWebhookQueueFull, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected error %v got %v", context.DeadlineExceeded, err)
+	}
+	if len(dead) != 3 {
+		t.Errorf("expected the 3 events left to be dead lettered got %d", len(dead))
+	}
+}
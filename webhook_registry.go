@@ -0,0 +1,334 @@
+package gopify
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// webhook endpoint types, as the __typename of the endpoint in the graphql api
+const (
+	WebhookHttp        = "WebhookHttpEndpoint"
+	WebhookEventBridge = "WebhookEventBridgeEndpoint"
+	WebhookPubSub      = "WebhookPubSubEndpoint"
+)
+
+// WebhookEndpoint is where shopify delivers a webhook subscription
+type WebhookEndpoint struct {
+	Type          string `json:"__typename"`
+	CallbackUrl   string `json:"callbackUrl,omitempty"`
+	Arn           string `json:"arn,omitempty"`
+	PubSubProject string `json:"pubSubProject,omitempty"`
+	PubSubTopic   string `json:"pubSubTopic,omitempty"`
+}
+
+// HttpEndpoint delivers webhooks with https requests to url
+func HttpEndpoint(url string) WebhookEndpoint {
+	return WebhookEndpoint{Type: WebhookHttp, CallbackUrl: url}
+}
+
+// EventBridgeEndpoint delivers webhooks to the amazon EventBridge event source arn
+func EventBridgeEndpoint(arn string) WebhookEndpoint {
+	return WebhookEndpoint{Type: WebhookEventBridge, Arn: arn}
+}
+
+// PubSubEndpoint delivers webhooks to a google cloud Pub/Sub topic
+func PubSubEndpoint(project, topic string) WebhookEndpoint {
+	return WebhookEndpoint{Type: WebhookPubSub, PubSubProject: project, PubSubTopic: topic}
+}
+
+// WebhookSubscription is a webhook topic delivered to an endpoint
+type WebhookSubscription struct {
+	ID string
+	// Topic is the topic like orders/create, it is empty for subscriptions listed from shopify
+	// of topics that aren't in the registry
+	Topic string
+	// TopicEnum is the graphql enum value of the topic like ORDERS_CREATE
+	TopicEnum string
+	Endpoint  WebhookEndpoint
+	// IncludeFields limits the payload to the given fields, the whole payload is sent when empty
+	IncludeFields []string
+}
+
+// WebhookTopicEnum converts a topic like orders/create to its graphql enum value ORDERS_CREATE
+func WebhookTopicEnum(topic string) string {
+	return strings.ToUpper(strings.ReplaceAll(topic, "/", "_"))
+}
+
+// WebhookRegistry declares the webhook subscriptions of an app, one endpoint per topic
+type WebhookRegistry struct {
+	mu            sync.RWMutex
+	subscriptions map[string]WebhookSubscription
+}
+
+// NewWebhookRegistry creates an empty webhook registry
+func NewWebhookRegistry() *WebhookRegistry {
+	return &WebhookRegistry{
+		subscriptions: make(map[string]WebhookSubscription),
+	}
+}
+
+// Add subscribes to topic, like orders/create, delivered to endpoint with only includeFields in the payload if any,
+// it replaces the previous subscription of topic
+func (r *WebhookRegistry) Add(topic string, endpoint WebhookEndpoint, includeFields ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subscriptions[WebhookTopicEnum(topic)] = WebhookSubscription{
+		Topic:         topic,
+		TopicEnum:     WebhookTopicEnum(topic),
+		Endpoint:      endpoint,
+		IncludeFields: includeFields,
+	}
+}
+
+// Subscriptions returns the registered subscriptions sorted by topic
+func (r *WebhookRegistry) Subscriptions() []WebhookSubscription {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	subs := make([]WebhookSubscription, 0, len(r.subscriptions))
+	for _, sub := range r.subscriptions {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].Topic < subs[j].Topic
+	})
+	return subs
+}
+
+// WebhookSyncReport lists the changes SyncWebhooks made to the webhook subscriptions of a shop
+type WebhookSyncReport struct {
+	Created   []WebhookSubscription
+	Updated   []WebhookSubscription
+	Deleted   []WebhookSubscription
+	Unchanged []WebhookSubscription
+}
+
+const webhookSubscriptionsQuery = `query ($after: String) {
+	webhookSubscriptions(first: 100, after: $after) {
+		edges {
+			node {
+				id
+				topic
+				includeFields
+				endpoint {
+					__typename
+					... on WebhookHttpEndpoint { callbackUrl }
+					... on WebhookEventBridgeEndpoint { arn }
+					... on WebhookPubSubEndpoint { pubSubProject pubSubTopic }
+				}
+			}
+		}
+		pageInfo { hasNextPage endCursor }
+	}
+}`
+
+// WebhookSubscriptions returns the webhook subscriptions the app made on the shop,
+// only their TopicEnum is set since the enum can't be converted back to a topic reliably
+func (c *Client) WebhookSubscriptions(ctx context.Context) ([]WebhookSubscription, error) {
+	subs := []WebhookSubscription{}
+	err := c.GraphqlNodes(ctx, webhookSubscriptionsQuery, nil, "webhookSubscriptions", func(node json.RawMessage) error {
+		sub := struct {
+			ID            string          `json:"id"`
+			Topic         string          `json:"topic"`
+			IncludeFields []string        `json:"includeFields"`
+			Endpoint      WebhookEndpoint `json:"endpoint"`
+		}{}
+		if err := json.Unmarshal(node, &sub); err != nil {
+			return err
+		}
+		subs = append(subs, WebhookSubscription{
+			ID:            sub.ID,
+			TopicEnum:     sub.Topic,
+			Endpoint:      sub.Endpoint,
+			IncludeFields: sub.IncludeFields,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subs, nil
+}
+
+// webhookMutationPrefix returns the prefix of the create and update mutations of an endpoint type
+func webhookMutationPrefix(endpointType string) string {
+	switch endpointType {
+	case WebhookEventBridge:
+		return "eventBridgeWebhookSubscription"
+	case WebhookPubSub:
+		return "pubSubWebhookSubscription"
+	}
+	return "webhookSubscription"
+}
+
+// webhookSubscriptionInput returns the input of the create and update mutations of sub
+func webhookSubscriptionInput(sub WebhookSubscription) (string, map[string]any) {
+	input := map[string]any{
+		"format":        "JSON",
+		"includeFields": sub.IncludeFields,
+	}
+	if sub.IncludeFields == nil {
+		input["includeFields"] = []string{}
+	}
+	switch sub.Endpoint.Type {
+	case WebhookEventBridge:
+		input["arn"] = sub.Endpoint.Arn
+		return "EventBridgeWebhookSubscriptionInput", input
+	case WebhookPubSub:
+		input["pubSubProject"] = sub.Endpoint.PubSubProject
+		input["pubSubTopic"] = sub.Endpoint.PubSubTopic
+		return "PubSubWebhookSubscriptionInput", input
+	}
+	input["callbackUrl"] = sub.Endpoint.CallbackUrl
+	return "WebhookSubscriptionInput", input
+}
+
+// topicEnum returns the graphql enum value of the subscription topic
+func (sub WebhookSubscription) topicEnum() string {
+	if sub.TopicEnum != "" {
+		return sub.TopicEnum
+	}
+	return WebhookTopicEnum(sub.Topic)
+}
+
+// CreateWebhookSubscription subscribes the app to sub.Topic, or sub.TopicEnum, and returns the subscription with its id
+func (c *Client) CreateWebhookSubscription(ctx context.Context, sub WebhookSubscription) (*WebhookSubscription, error) {
+	name := webhookMutationPrefix(sub.Endpoint.Type) + "Create"
+	inputType, input := webhookSubscriptionInput(sub)
+	mutation := `mutation ($topic: WebhookSubscriptionTopic!, $input: ` + inputType + `!) {
+		` + name + `(topic: $topic, webhookSubscription: $input) {
+			webhookSubscription { id }
+			userErrors { field message }
+		}
+	}`
+	result := map[string]struct {
+		WebhookSubscription *struct {
+			ID string `json:"id"`
+		} `json:"webhookSubscription"`
+	}{}
+	sub.TopicEnum = sub.topicEnum()
+	vars := map[string]any{"topic": sub.TopicEnum, "input": input}
+	if err := c.GraphqlInto(ctx, mutation, vars, &result); err != nil {
+		return nil, err
+	}
+	if result[name].WebhookSubscription == nil {
+		return nil, ErrNoGraphqlData
+	}
+	sub.ID = result[name].WebhookSubscription.ID
+	return &sub, nil
+}
+
+// UpdateWebhookSubscription changes the endpoint and included fields of the subscription sub.ID,
+// the endpoint type can't be changed
+func (c *Client) UpdateWebhookSubscription(ctx context.Context, sub WebhookSubscription) error {
+	name := webhookMutationPrefix(sub.Endpoint.Type) + "Update"
+	inputType, input := webhookSubscriptionInput(sub)
+	mutation := `mutation ($id: ID!, $input: ` + inputType + `!) {
+		` + name + `(id: $id, webhookSubscription: $input) {
+			webhookSubscription { id }
+			userErrors { field message }
+		}
+	}`
+	return c.GraphqlInto(ctx, mutation, map[string]any{"id": sub.ID, "input": input}, &struct{}{})
+}
+
+// DeleteWebhookSubscription deletes the subscription with the given id
+func (c *Client) DeleteWebhookSubscription(ctx context.Context, id string) error {
+	mutation := `mutation ($id: ID!) {
+		webhookSubscriptionDelete(id: $id) {
+			deletedWebhookSubscriptionId
+			userErrors { field message }
+		}
+	}`
+	return c.GraphqlInto(ctx, mutation, map[string]any{"id": id}, &struct{}{})
+}
+
+// sameFields reports whether a and b hold the same fields in any order
+func sameFields(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// SyncWebhooks makes the webhook subscriptions of the shop of client match the registry.
+// It creates the missing subscriptions, updates the ones with a different endpoint or included fields,
+// and deletes the ones of topics that aren't registered and the extra ones of registered topics.
+// The report lists the changes made before an error, if any.
+func (r *WebhookRegistry) SyncWebhooks(ctx context.Context, client *Client) (*WebhookSyncReport, error) {
+	existing, err := client.WebhookSubscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byTopic := make(map[string][]WebhookSubscription)
+	for _, sub := range existing {
+		byTopic[sub.TopicEnum] = append(byTopic[sub.TopicEnum], sub)
+	}
+
+	report := &WebhookSyncReport{}
+	stale := []WebhookSubscription{}
+	for _, want := range r.Subscriptions() {
+		current := byTopic[want.TopicEnum]
+		delete(byTopic, want.TopicEnum)
+		// the subscriptions of registered topics are reported with the registered topic
+		for i := range current {
+			current[i].Topic = want.Topic
+		}
+
+		// keep an identical subscription, or else update one with the same endpoint type
+		match := -1
+		for i, sub := range current {
+			if sub.Endpoint == want.Endpoint && sameFields(sub.IncludeFields, want.IncludeFields) {
+				match = i
+				break
+			}
+			if match < 0 && sub.Endpoint.Type == want.Endpoint.Type {
+				match = i
+			}
+		}
+
+		switch {
+		case match < 0:
+			created, err := client.CreateWebhookSubscription(ctx, want)
+			if err != nil {
+				return report, err
+			}
+			report.Created = append(report.Created, *created)
+		case current[match].Endpoint == want.Endpoint && sameFields(current[match].IncludeFields, want.IncludeFields):
+			report.Unchanged = append(report.Unchanged, current[match])
+		default:
+			want.ID = current[match].ID
+			if err := client.UpdateWebhookSubscription(ctx, want); err != nil {
+				return report, err
+			}
+			report.Updated = append(report.Updated, want)
+		}
+		for i, sub := range current {
+			if i != match {
+				stale = append(stale, sub)
+			}
+		}
+	}
+	for _, subs := range byTopic {
+		stale = append(stale, subs...)
+	}
+
+	for _, sub := range stale {
+		if err := client.DeleteWebhookSubscription(ctx, sub.ID); err != nil {
+			return report, err
+		}
+		report.Deleted = append(report.Deleted, sub)
+	}
+	return report, nil
+}
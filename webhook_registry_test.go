@@ -0,0 +1,121 @@
+package gopify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestWebhookTopicEnum(t *testing.T) {
+	cases := []struct {
+		topic string
+		enum  string
+	}{
+		{"orders/create", "ORDERS_CREATE"},
+		{"app/uninstalled", "APP_UNINSTALLED"},
+		{"inventory_levels/update", "INVENTORY_LEVELS_UPDATE"},
+		{"customers/data_request", "CUSTOMERS_DATA_REQUEST"},
+		{"orders/partially_fulfilled", "ORDERS_PARTIALLY_FULFILLED"},
+		{"fulfillment_orders/placed_on_hold", "FULFILLMENT_ORDERS_PLACED_ON_HOLD"},
+		{"app_subscriptions/approaching_capped_amount", "APP_SUBSCRIPTIONS_APPROACHING_CAPPED_AMOUNT"},
+		{"orders/risk_assessment_changed", "ORDERS_RISK_ASSESSMENT_CHANGED"},
+		{"audit_events/admin_api_activity", "AUDIT_EVENTS_ADMIN_API_ACTIVITY"},
+		{"reverse_deliveries/attach_deliverable", "REVERSE_DELIVERIES_ATTACH_DELIVERABLE"},
+		{"orders/link_requested", "ORDERS_LINK_REQUESTED"},
+	}
+
+	for i, c := range cases {
+		if got := WebhookTopicEnum(c.topic); got != c.enum {
+			t.Errorf("case %d expected %s got %s", i, c.enum, got)
+		}
+	}
+}
+
+func TestSyncWebhooks(t *testing.T) {
+	mutations := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := struct {
+			Query     string         `json:"query"`
+			Variables map[string]any `json:"variables"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		switch {
+		case strings.Contains(body.Query, "webhookSubscriptions("):
+			fmt.Fprint(w, `{"data": {"webhookSubscriptions": {"edges": [
+				{"node": {"id": "gid/1", "topic": "ORDERS_CREATE", "includeFields": [], "endpoint": {"__typename": "WebhookHttpEndpoint", "callbackUrl": "https://example.com/orders"}}},
+				{"node": {"id": "gid/2", "topic": "PRODUCTS_UPDATE", "includeFields": [], "endpoint": {"__typename": "WebhookHttpEndpoint", "callbackUrl": "https://old.example.com/products"}}},
+				{"node": {"id": "gid/3", "topic": "APP_UNINSTALLED", "includeFields": [], "endpoint": {"__typename": "WebhookHttpEndpoint", "callbackUrl": "https://example.com/uninstalled"}}},
+				{"node": {"id": "gid/4", "topic": "ORDERS_CREATE", "includeFields": [], "endpoint": {"__typename": "WebhookPubSubEndpoint", "pubSubProject": "project", "pubSubTopic": "orders"}}}
+			], "pageInfo": {"hasNextPage": false, "endCursor": "cursor"}}}}`)
+		case strings.Contains(body.Query, "eventBridgeWebhookSubscriptionCreate("):
+			mutations = append(mutations, fmt.Sprintf("create %v %v", body.Variables["topic"], body.Variables["input"]))
+			fmt.Fprint(w, `{"data": {"eventBridgeWebhookSubscriptionCreate": {"webhookSubscription": {"id": "gid/5"}, "userErrors": []}}}`)
+		case strings.Contains(body.Query, "webhookSubscriptionUpdate("):
+			mutations = append(mutations, fmt.Sprintf("update %v %v", body.Variables["id"], body.Variables["input"]))
+			fmt.Fprint(w, `{"data": {"webhookSubscriptionUpdate": {"webhookSubscription": {"id": "gid/2"}, "userErrors": []}}}`)
+		case strings.Contains(body.Query, "webhookSubscriptionDelete("):
+			mutations = append(mutations, fmt.Sprintf("delete %v", body.Variables["id"]))
+			fmt.Fprintf(w, `{"data": {"webhookSubscriptionDelete": {"deletedWebhookSubscriptionId": "%v", "userErrors": []}}}`, body.Variables["id"])
+		default:
+			t.Errorf("unexpected query %s", body.Query)
+		}
+	}))
+	defer ts.Close()
+
+	apiClient := NewClient("osama.myshopify.com", "token")
+	apiClient.baseUrl = fmt.Sprintf("%s/admin/api/%s", ts.URL, apiClient.version)
+
+	registry := NewWebhookRegistry()
+	registry.Add("orders/create", HttpEndpoint("https://example.com/orders"))
+	registry.Add("products/update", HttpEndpoint("https://example.com/products"), "id", "title")
+	registry.Add("customers/data_request", EventBridgeEndpoint("arn:aws:events:us-east-1::event-source/aws.partner/shopify.com/1/source"))
+
+	report, err := registry.SyncWebhooks(context.Background(), apiClient)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	sort.Strings(mutations)
+	expected := []string{
+		"create CUSTOMERS_DATA_REQUEST map[arn:arn:aws:events:us-east-1::event-source/aws.partner/shopify.com/1/source format:JSON includeFields:[]]",
+		"delete gid/3",
+		"delete gid/4",
+		"update gid/2 map[callbackUrl:https://example.com/products format:JSON includeFields:[id title]]",
+	}
+	if fmt.Sprint(mutations) != fmt.Sprint(expected) {
+		t.Errorf("expected mutations %v got %v", expected, mutations)
+	}
+
+	ids := func(subs []WebhookSubscription) string {
+		s := []string{}
+		for _, sub := range subs {
+			s = append(s, sub.ID)
+		}
+		sort.Strings(s)
+		return strings.Join(s, ",")
+	}
+	if ids(report.Created) != "gid/5" || ids(report.Updated) != "gid/2" || ids(report.Deleted) != "gid/3,gid/4" || ids(report.Unchanged) != "gid/1" {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if report.Created[0].Topic != "customers/data_request" || report.Created[0].TopicEnum != "CUSTOMERS_DATA_REQUEST" {
+		t.Errorf("unexpected created subscription %+v", report.Created[0])
+	}
+	if report.Unchanged[0].Topic != "orders/create" || report.Updated[0].Topic != "products/update" {
+		t.Errorf("expected registered topics to be reported with their topic got %+v", report)
+	}
+	// the topic of unregistered subscriptions isn't guessed from the enum
+	for _, sub := range report.Deleted {
+		if sub.ID == "gid/3" && (sub.Topic != "" || sub.TopicEnum != "APP_UNINSTALLED") {
+			t.Errorf("unexpected deleted subscription %+v", sub)
+		}
+		if sub.ID == "gid/4" && sub.Topic != "orders/create" {
+			t.Errorf("unexpected deleted subscription %+v", sub)
+		}
+	}
+}
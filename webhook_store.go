@@ -0,0 +1,131 @@
+package gopify
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// WebhookStore records the webhooks that are handled or being handled, so duplicate deliveries can be skipped
+type WebhookStore interface {
+	// Reserve records id until ttl passes, it returns false when id is already recorded
+	Reserve(ctx context.Context, id string, ttl time.Duration) (bool, error)
+	// Release forgets id so the webhook can be handled again
+	Release(ctx context.Context, id string) error
+}
+
+type webhookEntry struct {
+	id      string
+	expires time.Time
+}
+
+// MemoryWebhookStore keeps the most recently reserved webhook ids in memory, it is safe for concurrent use
+type MemoryWebhookStore struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+	now     func() time.Time
+}
+
+// NewMemoryWebhookStore creates a webhook store that keeps up to size ids, the least recently reserved are evicted first
+func NewMemoryWebhookStore(size int) *MemoryWebhookStore {
+	return &MemoryWebhookStore{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+func (m *MemoryWebhookStore) Reserve(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if el, ok := m.entries[id]; ok {
+		if now.Before(el.Value.(*webhookEntry).expires) {
+			return false, nil
+		}
+		m.remove(el)
+	}
+
+	m.entries[id] = m.order.PushFront(&webhookEntry{id: id, expires: now.Add(ttl)})
+	for m.size > 0 && m.order.Len() > m.size {
+		m.remove(m.order.Back())
+	}
+	return true, nil
+}
+
+func (m *MemoryWebhookStore) Release(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.entries[id]; ok {
+		m.remove(el)
+	}
+	return nil
+}
+
+func (m *MemoryWebhookStore) remove(el *list.Element) {
+	m.order.Remove(el)
+	delete(m.entries, el.Value.(*webhookEntry).id)
+}
+
+// SQLWebhookStore keeps webhook ids in a database/sql table
+type SQLWebhookStore struct {
+	db     *sql.DB
+	config sqlConfig
+}
+
+// NewSQLWebhookStore creates a webhook store using db, the table is named gopify_webhooks unless WithTable is used.
+// Call CreateTable to create the table if it doesn't exist.
+func NewSQLWebhookStore(db *sql.DB, opts ...SQLOption) *SQLWebhookStore {
+	return &SQLWebhookStore{
+		db:     db,
+		config: newSQLConfig("gopify_webhooks", opts),
+	}
+}
+
+// CreateTable creates the webhooks table if it doesn't exist
+func (s *SQLWebhookStore) CreateTable(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+s.config.table+` (
+		id VARCHAR(255) PRIMARY KEY,
+		expires BIGINT NOT NULL
+	)`)
+	return err
+}
+
+// Reserve deletes the expired reservation of id if any, then reserves it.
+func (s *SQLWebhookStore) Reserve(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	_, err := s.db.ExecContext(ctx, s.config.query(`DELETE FROM `+s.config.table+` WHERE id = ? AND expires <= ?`), id, now.Unix())
+	if err != nil {
+		return false, err
+	}
+	// the primary key makes the insert fail when the id is already reserved,
+	// the error is only returned when the row doesn't exist since constraint errors aren't portable across drivers.
+	// The queries don't share a transaction since a failed insert aborts it on some databases, so a concurrent
+	// Release between the insert and the count makes Reserve return the insert error, and the webhook is
+	// handled when shopify retries it.
+	_, err = s.db.ExecContext(ctx, s.config.query(`INSERT INTO `+s.config.table+` (id, expires) VALUES (?, ?)`), id, now.Add(ttl).Unix())
+	if err == nil {
+		return true, nil
+	}
+	var exists int
+	if qerr := s.db.QueryRowContext(ctx, s.config.query(`SELECT COUNT(*) FROM `+s.config.table+` WHERE id = ?`), id).Scan(&exists); qerr != nil || exists == 0 {
+		return false, err
+	}
+	return false, nil
+}
+
+func (s *SQLWebhookStore) Release(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, s.config.query(`DELETE FROM `+s.config.table+` WHERE id = ?`), id)
+	return err
+}
+
+// DeleteExpired deletes the expired webhook ids, call it periodically to keep the table small
+func (s *SQLWebhookStore) DeleteExpired(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, s.config.query(`DELETE FROM `+s.config.table+` WHERE expires <= ?`), time.Now().Unix())
+	return err
+}
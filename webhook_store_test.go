@@ -0,0 +1,86 @@
+package gopify
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryWebhookStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	store := NewMemoryWebhookStore(2)
+	store.now = func() time.Time { return now }
+
+	reserve := func(id string, expected bool) {
+		t.Helper()
+		ok, err := store.Reserve(ctx, id, time.Minute)
+		if err != nil || ok != expected {
+			t.Errorf("expected reserving %s to be %v got %v, %v", id, expected, ok, err)
+		}
+	}
+
+	reserve("a", true)
+	reserve("a", false)
+
+	// released ids can be reserved again
+	store.Release(ctx, "a")
+	reserve("a", true)
+
+	// expired ids can be reserved again
+	now = now.Add(2 * time.Minute)
+	reserve("a", true)
+
+	// the least recently reserved id is evicted
+	reserve("b", true)
+	reserve("c", true)
+	reserve("a", true)
+	reserve("c", false)
+}
+
+func TestSQLWebhookStore(t *testing.T) {
+	ctx := context.Background()
+	db := openFakeDB(t)
+	store := NewSQLWebhookStore(db, WithDollarPlaceholders())
+
+	// without the table the failed insert is reported
+	if _, err := store.Reserve(ctx, "a", time.Minute); err == nil {
+		t.Errorf("expected an error without the table")
+	}
+	if err := store.CreateTable(ctx); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	reserve := func(id string, ttl time.Duration, expected bool) {
+		t.Helper()
+		ok, err := store.Reserve(ctx, id, ttl)
+		if err != nil || ok != expected {
+			t.Errorf("expected reserving %s to be %v got %v, %v", id, expected, ok, err)
+		}
+	}
+
+	reserve("a", time.Minute, true)
+	reserve("a", time.Minute, false)
+	reserve("b", time.Minute, true)
+
+	// released ids can be reserved again
+	if err := store.Release(ctx, "a"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	reserve("a", time.Minute, true)
+
+	// expired rows are replaced
+	reserve("c", -time.Second, true)
+	reserve("c", time.Minute, true)
+	reserve("c", time.Minute, false)
+
+	reserve("d", -time.Second, true)
+	if err := store.DeleteExpired(ctx); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM gopify_webhooks WHERE id = $1`, "d").Scan(&count); err != nil || count != 0 {
+		t.Errorf("expected the expired row to be deleted got %d, %v", count, err)
+	}
+	reserve("b", time.Minute, false)
+}
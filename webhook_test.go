@@ -2,35 +2,194 @@ package gopify
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
+// webhookMac computes the hmac header shopify sends with body
+func webhookMac(body, secret string) string {
+	hasher := hmac.New(sha256.New, []byte(secret))
+	hasher.Write([]byte(body))
+	return base64.StdEncoding.EncodeToString(hasher.Sum(nil))
+}
+
+// newWebhookRequest creates a webhook request signed with secret
+func newWebhookRequest(topic, body, secret string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/webhooks", bytes.NewBufferString(body))
+	req.Header.Set(ShopifyHmacHeader, webhookMac(body, secret))
+	req.Header.Set(ShopifyTopicHeader, topic)
+	req.Header.Set(ShopifyShopDomainHeader, "osama.myshopify.com")
+	req.Header.Set(ShopifyWebhookIdHeader, "b54557e4-bdd9-4b37-8a5f-bf7d70bcd043")
+	req.Header.Set(ShopifyApiVersionHeader, "2023-01")
+	req.Header.Set(ShopifyTriggeredAtHeader, "2023-03-29T18:00:27.877041743Z")
+	return req
+}
+
 func TestVerifyWebhook(t *testing.T) {
 	gopify := Gopify{
-		ApiKey:      "key",
-		ApiSecret:   "hush",
-		RedirectUrl: "https://example.com/auth",
-		Scopes:      []string{"read_products"},
+		ApiKey:             "key",
+		ApiSecret:          "hush",
+		RedirectUrl:        "https://example.com/auth",
+		Scopes:             []string{"read_products"},
+		OldApiSecrets:      []string{"old"},
+		MaxWebhookBodySize: 64,
 	}
 
 	cases := []struct {
 		payload  []byte
 		mac      string
-		expected bool
+		expected error
 	}{
-		{[]byte("webhook request body"), "MzE4OWFmOThjYmIyODA2ZmZmZWFmMjdmYzQ2ZTg3MTM1M2FmZTNlYmMzMGYzNTNkMDA0ZjQyNjkxMGZjNzEzNA==", true},
-		{[]byte("webhook request body"), "wronghash", false},
+		{[]byte("webhook request body"), "MYmvmMuygG//6vJ/xG6HE1Ov4+vDDzU9AE9CaRD8cTQ=", nil},
+		// signed with the previous app secret
+		{[]byte("webhook request body"), "p/vTY2jvizDobdd7trN2Zfsdl6/uT5JUR/rgaNd6FWI=", nil},
+		// the base64 encoded hex digest
+		{[]byte("webhook request body"), "MzE4OWFmOThjYmIyODA2ZmZmZWFmMjdmYzQ2ZTg3MTM1M2FmZTNlYmMzMGYzNTNkMDA0ZjQyNjkxMGZjNzEzNA==", ErrInvalidWebhookRequest},
+		{[]byte("webhook request body"), "wronghash", ErrInvalidWebhookRequest},
+		{[]byte("webhook request body"), "", ErrInvalidWebhookRequest},
+		{bytes.Repeat([]byte("a"), 65), webhookMac(strings.Repeat("a", 65), "hush"), ErrWebhookTooLarge},
 	}
 
-	for _, c := range cases {
+	for i, c := range cases {
 		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(c.payload))
 		req.Header.Add("X-Shopify-Hmac-SHA256", c.mac)
-		valid := gopify.VerifyWebhook(req)
+		err := gopify.VerifyWebhook(req)
+
+		if !errors.Is(err, c.expected) || (c.expected == nil && err != nil) {
+			t.Errorf("case %d webhook verification expected error %v got %v", i, c.expected, err)
+		}
+		if c.expected != ErrWebhookTooLarge {
+			if body, _ := io.ReadAll(req.Body); !bytes.Equal(body, c.payload) {
+				t.Errorf("case %d expected the request body to be preserved got %q", i, body)
+			}
+		}
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	gopify := &Gopify{ApiKey: "key", ApiSecret: "hush"}
+	var handled *WebhookEvent
+	h := gopify.NewWebhookHandler()
+	h.Handle("orders/create", func(ctx context.Context, e *WebhookEvent) error {
+		handled = e
+		return nil
+	})
+	h.Handle("orders/paid", func(ctx context.Context, e *WebhookEvent) error {
+		return errors.New("database is down")
+	})
 
-		if valid != c.expected {
-			t.Errorf("webhook verification expected %v got %v", c.expected, valid)
+	cases := []struct {
+		req      *http.Request
+		expected int
+		topic    string
+	}{
+		{newWebhookRequest("orders/create", `{"id": 1}`, "hush"), http.StatusOK, "orders/create"},
+		{newWebhookRequest("orders/create", `{"id": 1}`, "wrong"), http.StatusUnauthorized, ""},
+		{newWebhookRequest("orders/paid", `{"id": 1}`, "hush"), http.StatusInternalServerError, ""},
+		// topics without a handler are acknowledged so shopify doesn't retry them
+		{newWebhookRequest("products/update", `{"id": 1}`, "hush"), http.StatusOK, ""},
+		{newWebhookRequest("orders/create", strings.Repeat(" ", 11<<20), "hush"), http.StatusRequestEntityTooLarge, ""},
+	}
+
+	for i, c := range cases {
+		handled = nil
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, c.req)
+
+		if rec.Code != c.expected {
+			t.Errorf("case %d expected %d status code but got %d", i, c.expected, rec.Code)
 		}
+		if c.topic == "" {
+			if handled != nil {
+				t.Errorf("case %d expected the event not to be handled", i)
+			}
+			continue
+		}
+		if handled == nil || handled.Topic != c.topic || handled.Shop != "osama.myshopify.com" || handled.ApiVersion != "2023-01" ||
+			handled.WebhookID == "" || string(handled.Body) != `{"id": 1}` {
+			t.Errorf("case %d unexpected event %+v", i, handled)
+		}
+		if !handled.TriggeredAt.Equal(time.Date(2023, 3, 29, 18, 0, 27, 877041743, time.UTC)) {
+			t.Errorf("case %d unexpected triggered at %v", i, handled.TriggeredAt)
+		}
+	}
+
+	// the default handler gets the topics without a handler
+	h.HandleDefault(func(ctx context.Context, e *WebhookEvent) error {
+		handled = e
+		return nil
+	})
+	if err := h.Dispatch(context.Background(), &WebhookEvent{Topic: "products/update"}); err != nil || handled.Topic != "products/update" {
+		t.Errorf("expected the default handler to handle the event got %v", err)
+	}
+}
+
+func TestDeduplicateWebhooks(t *testing.T) {
+	gopify := &Gopify{ApiKey: "key", ApiSecret: "hush"}
+	calls := 0
+	fail := false
+	h := gopify.DeduplicateWebhooks(NewMemoryWebhookStore(100), 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	withIDs := func(webhookID, eventID string) *http.Request {
+		req := newWebhookRequest("orders/create", `{"id": 1}`, "hush")
+		req.Header.Set(ShopifyWebhookIdHeader, webhookID)
+		req.Header.Set(ShopifyEventIdHeader, eventID)
+		return req
+	}
+
+	cases := []struct {
+		req      *http.Request
+		fail     bool
+		expected int
+		calls    int
+	}{
+		{withIDs("1", "event1"), false, http.StatusOK, 1},
+		// the same delivery
+		{withIDs("1", "event1"), false, http.StatusOK, 1},
+		// the same event delivered with another webhook id
+		{withIDs("2", "event1"), false, http.StatusOK, 1},
+		{withIDs("3", "event3"), true, http.StatusInternalServerError, 2},
+		// the failed delivery is handled again when shopify retries it
+		{withIDs("3", "event3"), false, http.StatusOK, 3},
+		{newWebhookRequest("orders/create", `{"id": 1}`, "wrong"), false, http.StatusUnauthorized, 3},
+	}
+
+	for i, c := range cases {
+		fail = c.fail
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, c.req)
+
+		if rec.Code != c.expected {
+			t.Errorf("case %d expected %d status code but got %d", i, c.expected, rec.Code)
+		}
+		if calls != c.calls {
+			t.Errorf("case %d expected the handler to be called %d times got %d", i, c.calls, calls)
+		}
+	}
+}
+
+func TestParseWebhookEventLimit(t *testing.T) {
+	gopify := &Gopify{ApiKey: "key", ApiSecret: "hush", MaxWebhookBodySize: 8}
+
+	e, err := gopify.ParseWebhookEvent(newWebhookRequest("orders/create", `{"id":1}`, "hush"))
+	if err != nil || string(e.Body) != `{"id":1}` || e.Topic != "orders/create" {
+		t.Errorf("unexpected event %+v, %v", e, err)
+	}
+	if _, err := gopify.ParseWebhookEvent(newWebhookRequest("orders/create", `{"id":10}`, "hush")); err != ErrWebhookTooLarge {
+		t.Errorf("expected error %v got %v", ErrWebhookTooLarge, err)
 	}
 }